@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path"
+	"sync"
+)
+
+// Directory in the data directory holding the document contents, one blob
+// file per SHA-256 digest, shared by all documents with the same contents.
+// Blobs are kept in fan-out directories named after the first digits of
+// their digest.
+const blobsDir = ".blobs"
+
+var (
+	// Held by every transaction changing blob references, and until the
+	// blobs it left without references are removed.
+	blobMu sync.Mutex
+	// Blobs left without references by the current transaction, removed
+	// once it is committed.
+	releasedBlobs []string
+	// Number of uploads in progress of each blob, by name, guarded by
+	// blobMu. A blob being uploaded is not removed when a transaction
+	// leaves it without references.
+	uploadingBlobs = map[string]int{}
+)
+
+// Database buckets for the blob store.
+var (
+	// Number of metadata records referring to each blob, keyed by the
+	// name given by blobName: its digest, with a suffix if compressed.
+	// Earlier versions of a document count as references too.
+	blobsBucket = []byte("Blobs")
+	// Index on DocMetadata.SHA256.
+	digestIndexBucket = []byte("IdxSHA256")
+)
+
+// Get the name of the blob or inline contents of a document, or "" for a
+// document stored before contents were deduplicated. It is the digest of
+// the contents, with suffixes for contents compressed or encrypted at rest,
+// which differ from the plain contents other documents may have. Contents
+// encrypted at rest are named by their keyed digest instead, if they have
+// one.
+func blobName(metadata *DocMetadata) string {
+	name := metadata.SHA256
+	if name == "" {
+		return ""
+	}
+	if metadata.KeyID != "" && metadata.BlobDigest != "" {
+		name = metadata.BlobDigest
+	}
+	if metadata.Encoding == gzipEncoding {
+		name += gzipBlobSuffix
+	}
+	if metadata.KeyID != "" {
+		name += "." + metadata.KeyID + encryptedBlobSuffix
+	}
+	return name
+}
+
+// Get the path to the blob with a SHA-256 digest. Blobs not yet moved out of
+// the flat layout by migrateLayout are found too.
+func blobPath(digest string) string {
+	return locate(shardedBlobPath(digest), path.Join(dataDir, blobsDir, digest))
+}
+
+// Get the path to the blob with a SHA-256 digest in the sharded layout.
+func shardedBlobPath(digest string) string {
+	return path.Join(dataDir, blobsDir, shardDirs(digest), digest)
+}
+
+// Get the path to the file of a document stored under its key, in the
+// sharded layout or, if not yet migrated, in the data directory.
+func legacyPath(key string) string {
+	name := keyFileName(key)
+	return locate(shardedLegacyPath(name), path.Join(dataDir, name))
+}
+
+// Sync a directory, so the files renamed into it are on disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Run a read-write transaction that may change blob references, then remove
+// the blobs it left without references once it is committed. A crash in
+// between leaves unreferenced blobs behind, but never a reference to a
+// missing blob.
+func updateBlobs(fn func(metaTx) error) error {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+	releasedBlobs = nil
+	err := db.update(fn)
+	released := releasedBlobs
+	releasedBlobs = nil
+	if err != nil || len(released) == 0 {
+		return err
+	}
+	var unused []string
+	err = db.view(func(tx metaTx) error {
+		for _, digest := range released {
+			// A blob released in a transaction may be referenced again
+			// later in the same transaction.
+			if getBlobRefs(tx, digest) == 0 {
+				unused = append(unused, digest)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, digest := range unused {
+		if uploadingBlobs[digest] > 0 {
+			continue
+		}
+		if err = blobs.remove(digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Upload a file as the blob with a name before the transaction adding a
+// reference to it, without holding blobMu, so a slow blob store does not
+// hold up other writes. The blob is kept until the returned function is
+// called once the transaction is done, which removes it if it was left
+// without references. A blob that cannot be removed, or that is uploaded
+// before a crash, is left for fsck.
+func uploadBlob(name, filePath string) (func(), error) {
+	blobMu.Lock()
+	uploadingBlobs[name]++
+	blobMu.Unlock()
+	done := func() {
+		blobMu.Lock()
+		defer blobMu.Unlock()
+		if uploadingBlobs[name]--; uploadingBlobs[name] > 0 {
+			return
+		}
+		delete(uploadingBlobs, name)
+		var refs int64
+		err := db.view(func(tx metaTx) error {
+			refs = getBlobRefs(tx, name)
+			return nil
+		})
+		if err == nil && refs == 0 {
+			blobs.remove(name)
+		}
+	}
+	if err := blobs.put(name, filePath); err != nil {
+		done()
+		return nil, err
+	}
+	return done, nil
+}
+
+// Get the number of references to a blob within a transaction.
+func getBlobRefs(tx metaTx, digest string) int64 {
+	v := tx.bucket(blobsBucket).get([]byte(digest))
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+// Add to the number of references to a blob within a transaction run with
+// updateBlobs. A blob left without references is removed after the
+// transaction, and inline contents within it.
+func addBlobRef(tx metaTx, digest string, delta int64) error {
+	if digest == "" {
+		return nil
+	}
+	refs := getBlobRefs(tx, digest) + delta
+	if refs > 0 {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(refs))
+		return tx.bucket(blobsBucket).put([]byte(digest), v)
+	}
+	releasedBlobs = append(releasedBlobs, digest)
+	if err := tx.bucket(inlineBucket).delete([]byte(digest)); err != nil {
+		return err
+	}
+	return tx.bucket(blobsBucket).delete([]byte(digest))
+}
+
+// Replace the reference counts of all blobs. Blobs left without references
+// are not removed.
+func setBlobRefs(refs map[string]int64) error {
+	return updateBlobs(func(tx metaTx) error {
+		if err := tx.deleteBucket(blobsBucket); err != nil {
+			return err
+		}
+		b, err := tx.createBucket(blobsBucket)
+		if err != nil {
+			return err
+		}
+		for digest, n := range refs {
+			if n <= 0 {
+				continue
+			}
+			v := make([]byte, 8)
+			binary.BigEndian.PutUint64(v, uint64(n))
+			if err = b.put([]byte(digest), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Move the blob references from one metadata record of a document to the
+// record replacing it, within a transaction. Either record may be nil.
+func moveBlobRef(tx metaTx, from, to *DocMetadata) error {
+	var fromDigest, toDigest string
+	if from != nil {
+		fromDigest = blobName(from)
+	}
+	if to != nil {
+		toDigest = blobName(to)
+	}
+	if fromDigest == toDigest {
+		return nil
+	}
+	// Add the new reference first, so a shared blob is never left without
+	// references.
+	if err := addBlobRef(tx, toDigest, 1); err != nil {
+		return err
+	}
+	return addBlobRef(tx, fromDigest, -1)
+}
+
+// Find a document with the contents with a SHA-256 digest within a
+// transaction. Returns "" if there is none.
+func findDigest(tx metaTx, digest string) string {
+	prefix := stringIndexPrefix(digest)
+	ic := &indexCursor{c: tx.bucket(digestIndexBucket).cursor(), prefix: prefix, valueLen: len(prefix)}
+	_, key := ic.seek(prefix)
+	return string(key)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBlobContent = "the same report from two feeds"
+
+func testBlobDigest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSharedBlob(t *testing.T) {
+	digest := testBlobDigest(testBlobContent)
+	for _, key := range []string{"blob-1", "blob-2"} {
+		gofight.New().POST("/document/"+key).
+			SetBody(testBlobContent).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+	}
+
+	gofight.New().GET("/document/blob-2/metadata").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.Equal(t, digest, resp.SHA256, "Digest should match the contents")
+				assert.Equal(t, int64(len(testBlobContent)), resp.Size, "Size should match the contents")
+			}
+		})
+	_, err := os.Stat(blobPath(digest))
+	assert.NoError(t, err, "Blob should exist")
+
+	cleanupDoc(t, "blob-1")
+	_, err = os.Stat(blobPath(digest))
+	assert.NoError(t, err, "Blob should be kept while referenced")
+	gofight.New().GET("/document/blob-2").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.Equal(t, testBlobContent, resp.Document)
+			}
+		})
+
+	cleanupDoc(t, "blob-2")
+	_, err = os.Stat(blobPath(digest))
+	assert.True(t, os.IsNotExist(err), "Blob should be removed with the last reference")
+}
+
+// Blob store whose uploads of one blob wait until released.
+type slowBlobStore struct {
+	blobStore
+	name    string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s slowBlobStore) put(digest, filePath string) error {
+	if digest == s.name {
+		s.started <- struct{}{}
+		<-s.release
+	}
+	return s.blobStore.put(digest, filePath)
+}
+
+func TestSlowBlobUpload(t *testing.T) {
+	digest := testBlobDigest(testBlobContent)
+	gofight.New().POST("/document/slow-0").
+		SetBody(testBlobContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	saved := blobs
+	store := slowBlobStore{blobStore: saved, name: digest, started: make(chan struct{}), release: make(chan struct{})}
+	blobs = store
+	defer func() { blobs = saved }()
+
+	uploaded := make(chan struct{})
+	go func() {
+		gofight.New().POST("/document/slow-1").
+			SetBody(testBlobContent).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+		close(uploaded)
+	}()
+	<-store.started
+
+	// Other writes go on during the upload, and the blob being uploaded is
+	// kept when its last reference is removed.
+	written := make(chan struct{})
+	go func() {
+		gofight.New().POST("/document/slow-2").
+			SetBody("other contents").
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+		cleanupDoc(t, "slow-0")
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Error("Writes should not wait for a blob upload")
+	}
+	close(store.release)
+	<-uploaded
+	<-written
+	defer cleanupDoc(t, "slow-2")
+	gofight.New().GET("/document/slow-1/content").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, testBlobContent, r.Body.String())
+		})
+	cleanupDoc(t, "slow-1")
+	_, err := os.Stat(blobPath(digest))
+	assert.True(t, os.IsNotExist(err), "Blob should be removed with the last reference")
+}
+
+func TestSharedBlobVersions(t *testing.T) {
+	r := gofight.New()
+	r.POST("/document/blob-versions").
+		SetBody(testBlobContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	r.PUT("/document/blob-versions").
+		SetBody("replaced contents").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	_, err := os.Stat(blobPath(testBlobDigest(testBlobContent)))
+	assert.NoError(t, err, "Blob of an earlier version should be kept")
+
+	cleanupDoc(t, "blob-versions")
+	for _, content := range []string{testBlobContent, "replaced contents"} {
+		_, err = os.Stat(blobPath(testBlobDigest(content)))
+		assert.True(t, os.IsNotExist(err), "Blobs should be removed with the document")
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	r := gofight.New()
+	r.POST("/document/blob-original").
+		SetBody(testBlobContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, "blob-original")
+
+	r.POST("/document").
+		SetQuery(gofight.H{"dedupe": "true"}).
+		SetBody(testBlobContent).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.True(t, resp.Ok, "Response ok should be true")
+				assert.Equal(t, "blob-original", resp.Key, "Existing key should be returned")
+			}
+		})
+	assert.Equal(t, []string{"blob-original"}, listKeys(t, gofight.H{}))
+
+	r.POST("/document").
+		SetQuery(gofight.H{"dedupe": "true"}).
+		SetBody("new contents").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.NotEqual(t, "blob-original", resp.Key, "New contents should get a new key")
+				cleanupDoc(t, resp.Key)
+			}
+		})
+}
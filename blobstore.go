@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Storage for document contents, as blobs named by their SHA-256 digest.
+// Reference counting and removal of unused blobs are done by the service;
+// a store only keeps the bytes. Missing blobs are reported with errors for
+// which os.IsNotExist is true.
+type blobStore interface {
+	// Store the contents of a synced local file as the blob with a digest,
+	// unless it is already stored. The file may be moved away. Once it
+	// returns, the blob must survive a crash: it runs before the
+	// transaction adding the first reference to the blob, not within it,
+	// so a blob stored before a crash may be left without references, for
+	// fsck to find.
+	put(digest, filePath string) error
+	// Open a blob for reading.
+	open(digest string) (blobReader, error)
+	// Get the size of a blob in bytes.
+	size(digest string) (int64, error)
+	// Remove a blob. Removing a missing blob is not an error.
+	remove(digest string) error
+	// Call a function with the digest of every stored blob.
+	list(fn func(digest string) error) error
+	// Move a blob out of the way, where it is kept for inspection but no
+	// longer found.
+	quarantine(digest string) error
+}
+
+// Contents of a blob or file being read.
+type blobReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Blob store in use.
+var blobs blobStore = fsBlobStore{}
+
+// Names of the blob store drivers, for the -storage flag.
+const (
+	fsStorage     = "fs"
+	memoryStorage = "memory"
+	s3Storage     = "s3"
+)
+
+// Settings of the S3-compatible blob store driver.
+type s3Settings struct {
+	// Base URL of the service, such as https://s3.amazonaws.com or
+	// http://localhost:9000.
+	endpoint string
+	bucket   string
+	region   string
+	// Prefix of the object names.
+	prefix    string
+	accessKey string
+	secretKey string
+}
+
+// Create the blob store for a driver name.
+func newBlobStore(driver string, s3 s3Settings) (blobStore, error) {
+	switch driver {
+	case fsStorage:
+		return fsBlobStore{}, nil
+	case memoryStorage:
+		return newMemoryBlobStore(), nil
+	case s3Storage:
+		return newS3BlobStore(s3)
+	}
+	return nil, fmt.Errorf("unknown storage %s", driver)
+}
+
+// Open the contents of a document. Documents stored before the contents
+// were deduplicated have no digest, and have a file of their own under
+// their key.
+func openContents(key string, metadata *DocMetadata) (blobReader, error) {
+	return decompressContents(metadata, func() (blobReader, error) { return openStoredContents(key, metadata) })
+}
+
+// Open the contents of a document as stored, compressed or not, but
+// decrypted.
+func openStoredContents(key string, metadata *DocMetadata) (blobReader, error) {
+	if metadata.SHA256 != "" {
+		return decryptContents(metadata, func() (blobReader, error) { return openBlob(metadata) })
+	}
+	return openMoved(func() string { return legacyPath(key) })
+}
+
+// Open the blob or inline contents of a document as stored.
+func openBlob(metadata *DocMetadata) (blobReader, error) {
+	if metadata.Inline {
+		return openInline(blobName(metadata))
+	}
+	return blobs.open(blobName(metadata))
+}
+
+// Get the size of the contents of a document as stored, compressed and
+// encrypted or not.
+func contentsSize(key string, metadata *DocMetadata) (int64, error) {
+	if metadata.Inline {
+		contents, err := getInline(blobName(metadata))
+		return int64(len(contents)), err
+	}
+	if metadata.SHA256 != "" {
+		return blobs.size(blobName(metadata))
+	}
+	fi, err := os.Stat(legacyPath(key))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Get the size of the contents being read, leaving it at the start.
+func readerSize(r io.Seeker) (int64, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return size, err
+}
+
+// Blob store keeping blobs as files in blobsDir in the data directory.
+type fsBlobStore struct{}
+
+// Move the file into the blob store and sync the directory, so the blob is
+// on disk before the transaction referring to it is committed.
+func (fsBlobStore) put(digest, filePath string) error {
+	_, err := os.Stat(blobPath(digest))
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	blob := shardedBlobPath(digest)
+	dir := path.Dir(blob)
+	if err = os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	if err = os.Rename(filePath, blob); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func (fsBlobStore) open(digest string) (blobReader, error) {
+	return openMoved(func() string { return blobPath(digest) })
+}
+
+func (fsBlobStore) size(digest string) (int64, error) {
+	fi, err := os.Stat(blobPath(digest))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (fsBlobStore) remove(digest string) error {
+	// The flat layout first, so a blob moved by a concurrent migration is
+	// still removed.
+	for _, p := range []string{path.Join(dataDir, blobsDir, digest), shardedBlobPath(digest)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fsBlobStore) list(fn func(digest string) error) error {
+	seen := map[string]bool{}
+	err := filepath.Walk(path.Join(dataDir, blobsDir), func(filePath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || seen[fi.Name()] {
+			return nil
+		}
+		seen[fi.Name()] = true
+		return fn(fi.Name())
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fsBlobStore) quarantine(digest string) error {
+	return quarantine(blobPath(digest))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const testStoreKey = "store-123"
+
+// Get the digests of the blobs in a store.
+func testListBlobs(t *testing.T, store blobStore) []string {
+	var digests []string
+	err := store.list(func(digest string) error {
+		digests = append(digests, digest)
+		return nil
+	})
+	assert.NoError(t, err)
+	return digests
+}
+
+// Write contents to a temporary file, returning its path.
+func writeTestFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "blob")
+	if assert.NoError(t, err) {
+		_, err = f.WriteString(content)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+	return f.Name()
+}
+
+// Save, read, replace and delete a document with a blob store in use.
+func testBlobStore(t *testing.T, store blobStore) {
+	saved := blobs
+	blobs = store
+	defer func() { blobs = saved }()
+
+	gofight.New().POST("/document/"+testStoreKey).
+		SetHeader(gofight.H{"Content-Type": "text/plain"}).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	digest := testBlobDigest(testContent)
+	size, err := store.size(digest)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(len(testContent)), size)
+	}
+
+	gofight.New().GET("/document/"+testStoreKey).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), testContent)
+		})
+	gofight.New().GET("/document/"+testStoreKey+"/content").
+		SetHeader(gofight.H{"Range": "bytes=5-9"}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPartialContent, r.Code)
+			assert.Equal(t, testContent[5:10], r.Body.String())
+		})
+	gofight.New().GET("/search?q=plain").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), `"snippet":"some \u003cem\u003eplain`)
+		})
+
+	gofight.New().PUT("/document/"+testStoreKey).
+		SetBody("replaced").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	assert.Len(t, testListBlobs(t, store), 2, "Earlier version should keep its blob")
+	assert.Contains(t, testVersionContents(t, testStoreKey, 1), testContent)
+
+	cleanupDoc(t, testStoreKey)
+	assert.Empty(t, testListBlobs(t, store), "Blobs should be removed with the document")
+	_, err = store.open(digest)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFSBlobStore(t *testing.T) {
+	testBlobStore(t, fsBlobStore{})
+}
+
+func TestMemoryBlobStore(t *testing.T) {
+	store := newMemoryBlobStore()
+	testBlobStore(t, store)
+
+	tmpPath := writeTestFile(t, "orphan")
+	defer os.Remove(tmpPath)
+	assert.NoError(t, store.put(testBlobDigest("orphan"), tmpPath))
+	f := &fsck{repair: true}
+	if assert.NoError(t, f.run()) {
+		assert.Empty(t, f.problems, "Nothing should be found in the default store")
+	}
+	saved := blobs
+	blobs = store
+	defer func() { blobs = saved }()
+	f = &fsck{repair: true}
+	if assert.NoError(t, f.run()) {
+		p := findFsckProblem(f, "orphan blob", testBlobDigest("orphan"))
+		if assert.NotNil(t, p) {
+			assert.Equal(t, "quarantined", p.repair)
+		}
+	}
+	assert.Empty(t, testListBlobs(t, store))
+	assert.Len(t, store.quarantined, 1)
+}
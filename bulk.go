@@ -0,0 +1,285 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// Number of documents whose metadata is committed in one transaction
+	// during a bulk upload.
+	bulkBatchSize = 100
+	// Number of bytes of text to index held by the pending documents of a
+	// bulk upload, above which they are committed.
+	bulkBatchTextSize = 32 << 20
+	// Suffix of the sidecar metadata file for a file in a bulk tar upload.
+	bulkSidecarSuffix = ".meta.json"
+	// Maximum size of a sidecar metadata file.
+	maxSidecarSize = 1 << 20
+)
+
+// Record for a document in a bulk upload: a newline-delimited JSON line,
+// or the sidecar metadata of a file in a tar upload. The document contents
+// are a string, or base64 if the encoding is "base64".
+type bulkRecord struct {
+	Key      string `json:"key,omitempty"`
+	Document string `json:"document,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	DocMetadata
+}
+
+// Get the metadata of the document in a bulk record. The fields set by the
+// service are ignored.
+func (r *bulkRecord) metadata() *DocMetadata {
+	metadata := r.DocMetadata
+	metadata.Timestamp = time.Now().Unix()
+	metadata.Updated = 0
+	metadata.Version = 0
+	return &metadata
+}
+
+// Get the key of the document in a bulk record, creating a new v4 UUID if
+// there is none.
+func (r *bulkRecord) key() string {
+	if r.Key == "" {
+		return uuid.NewV4().String()
+	}
+	return r.Key
+}
+
+// State of a bulk upload: the result of every document so far, and the
+// documents waiting for their metadata to be committed.
+type bulkUpload struct {
+	opts    saveOptions
+	items   []*ResponseType
+	pending []*pendingDocument
+	// Index in items of each pending document.
+	pendingItems []int
+	// Size of the text to index of the pending documents.
+	pendingText int
+}
+
+// Save a document of a bulk upload, committing the metadata of the pending
+// documents when a batch is full, or holds too much text to index.
+func (b *bulkUpload) add(key string, body io.Reader, metadata *DocMetadata) {
+	doc, _, res := writeDocument(key, body, metadata, b.opts)
+	b.items = append(b.items, res)
+	if doc == nil {
+		return
+	}
+	b.pending = append(b.pending, doc)
+	b.pendingItems = append(b.pendingItems, len(b.items)-1)
+	b.pendingText += len(doc.text)
+	if len(b.pending) >= bulkBatchSize || b.pendingText >= bulkBatchTextSize {
+		b.flush()
+	}
+}
+
+// Record a document of a bulk upload that could not be read.
+func (b *bulkUpload) fail(key, msg string, err error) {
+	b.items = append(b.items, newErrorResp(key, msg, err))
+}
+
+// Commit the metadata of the pending documents in one transaction.
+func (b *bulkUpload) flush() {
+	if len(b.pending) == 0 {
+		return
+	}
+	err := commitDocuments(b.pending...)
+	for i, doc := range b.pending {
+		item := b.pendingItems[i]
+		if err != nil {
+			b.items[item] = newErrorResp(doc.key, "file metadata write error", fmt.Errorf("error saving metadata for key %s: %s", doc.key, err.Error()))
+		} else {
+			_, b.items[item] = doc.result(b.items[item])
+		}
+	}
+	b.pending = b.pending[:0]
+	b.pendingItems = b.pendingItems[:0]
+	b.pendingText = 0
+}
+
+// Discard the pending documents of a bulk upload whose body could not be
+// read, so that nothing after the error is saved.
+func (b *bulkUpload) discard(err error) {
+	for i, doc := range b.pending {
+		os.Remove(doc.tmpPath)
+		b.items[b.pendingItems[i]] = newErrorResp(doc.key, "input error", fmt.Errorf("not saved after error reading bulk upload: %s", err))
+	}
+	b.pending = b.pending[:0]
+	b.pendingItems = b.pendingItems[:0]
+	b.pendingText = 0
+}
+
+// Read a newline-delimited JSON bulk upload, with a bulkRecord per line.
+// A line that cannot be read fails on its own.
+func (b *bulkUpload) readNDJSON(body io.Reader) error {
+	r := bufio.NewReader(body)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			b.addRecord(line, data)
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Save the document of a newline-delimited JSON record.
+func (b *bulkUpload) addRecord(line int, data []byte) {
+	var record bulkRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		b.fail("", "input error", fmt.Errorf("line %d: %s", line, err))
+		return
+	}
+	content := []byte(record.Document)
+	switch record.Encoding {
+	case "":
+	case "base64":
+		var err error
+		if content, err = base64.StdEncoding.DecodeString(record.Document); err != nil {
+			b.fail(record.Key, "input error", fmt.Errorf("line %d: %s", line, err))
+			return
+		}
+	default:
+		b.fail(record.Key, "input error", fmt.Errorf("line %d: unknown encoding %s", line, record.Encoding))
+		return
+	}
+	b.add(record.key(), bytes.NewReader(content), record.metadata())
+}
+
+// Read a tar bulk upload. Each regular file is a document, described by an
+// optional sidecar file of the same name plus ".meta.json" holding a JSON
+// bulkRecord without the document, which must come before the file.
+// Without a key in the sidecar, a new v4 UUID is created. The name of the
+// file and the content type for its extension are used if the sidecar does
+// not set them.
+func (b *bulkUpload) readTar(body io.Reader) error {
+	tr := tar.NewReader(body)
+	sidecars := map[string]*bulkRecord{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(hdr.Name, bulkSidecarSuffix) {
+			var record bulkRecord
+			if err = json.NewDecoder(io.LimitReader(tr, maxSidecarSize)).Decode(&record); err != nil {
+				b.fail("", "input error", fmt.Errorf("%s: %s", hdr.Name, err))
+				continue
+			}
+			sidecars[strings.TrimSuffix(hdr.Name, bulkSidecarSuffix)] = &record
+			continue
+		}
+		record, ok := sidecars[hdr.Name]
+		if !ok {
+			record = &bulkRecord{}
+		}
+		delete(sidecars, hdr.Name)
+		metadata := record.metadata()
+		if metadata.Name == "" {
+			metadata.Name = path.Base(hdr.Name)
+		}
+		if metadata.ContentType == "" {
+			metadata.ContentType = mime.TypeByExtension(path.Ext(hdr.Name))
+		}
+		b.add(record.key(), tr, metadata)
+	}
+	var names []string
+	for name := range sidecars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.fail(sidecars[name].Key, "input error", fmt.Errorf("%s%s: no file %s before the end of the archive", name, bulkSidecarSuffix, name))
+	}
+	return nil
+}
+
+// Add many documents in one request, from a newline-delimited JSON stream
+// (application/x-ndjson) or a tar archive (application/x-tar). Existing
+// documents are not replaced, and with "dedupe=true" neither are documents
+// with the same contents as an existing one. The metadata is committed in
+// batches rather than per document. A body sent with Content-MD5 or Digest
+// headers is checked against them before any document is saved. If the
+// body cannot be read, the documents not committed yet are discarded. The
+// response has a result item per document, in upload order.
+func bulkDocs(c echo.Context) error {
+	r := c.Request()
+	defer r.Body.Close()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get(echo.HeaderContentType))
+	if mediaType != "application/x-ndjson" && mediaType != "application/x-tar" {
+		return c.JSON(statusUnsupportedMediaType, newErrorResp("", "input error", fmt.Errorf("unsupported bulk content type %s", mediaType)))
+	}
+	digests, err := expectedDigests(r.Header)
+	if err != nil {
+		return c.JSON(statusBadRequest, newErrorResp("", "input error", err))
+	}
+	var body io.Reader = r.Body
+	if len(digests) > 0 || digestedRequest(r) {
+		f, err := spoolBody(r.Body, digests)
+		if _, ok := err.(bodyDigestError); ok {
+			return c.JSON(statusBadRequest, newErrorResp("", "digest mismatch", err))
+		}
+		if err != nil {
+			return c.JSON(statusBadRequest, newErrorResp("", "input error", fmt.Errorf("error reading bulk upload: %s", err)))
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		body = f
+	}
+
+	b := &bulkUpload{opts: uploadOptions(r.URL.Query(), nil, false), items: []*ResponseType{}}
+	if mediaType == "application/x-ndjson" {
+		err = b.readNDJSON(body)
+	} else {
+		err = b.readTar(body)
+	}
+	if err != nil {
+		b.discard(err)
+	} else {
+		b.flush()
+	}
+
+	saved := 0
+	for _, item := range b.items {
+		if item.Ok {
+			saved++
+		}
+	}
+	res := newSuccessResp("", fmt.Sprintf("saved %d of %d documents", saved, len(b.items)))
+	if err != nil {
+		res = newErrorResp("", "input error", fmt.Errorf("error reading bulk upload after %d documents: %s", len(b.items), err))
+	} else if saved < len(b.items) {
+		res.Ok = false
+	}
+	res.Items = b.items
+	if err != nil {
+		return c.JSON(statusBadRequest, res)
+	}
+	return c.JSON(statusOk, res)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulkNDJSON(t *testing.T) {
+	body := `{"key": "bulk-1", "document": "first", "extractor": "test-extractor"}
+{"key": "bulk-2", "document": "c2Vjb25k", "encoding": "base64", "content-type": "text/plain"}
+not json
+
+{"document": "third", "meta": {"source": "feed-a"}}
+`
+	var resp ResponseType
+	gofight.New().POST("/documents/_bulk").
+		SetHeader(gofight.H{
+			"Content-Type": "application/x-ndjson",
+		}).
+		SetBody(body).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.NoError(t, json.Unmarshal([]byte(r.Body.String()), &resp))
+		})
+	if !assert.Len(t, resp.Items, 4) {
+		return
+	}
+	assert.False(t, resp.Ok, "Response ok should be false with a failed item")
+	assert.True(t, resp.Items[0].Ok)
+	assert.Equal(t, "bulk-1", resp.Items[0].Key)
+	assert.True(t, resp.Items[1].Ok)
+	assert.False(t, resp.Items[2].Ok, "Invalid line should fail")
+	assert.True(t, resp.Items[3].Ok)
+	defer cleanupDoc(t, "bulk-1")
+	defer cleanupDoc(t, "bulk-2")
+	defer cleanupDoc(t, resp.Items[3].Key)
+
+	metadata, err := getMetadata("bulk-1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, testExtractor, metadata.Extractor)
+		assert.NotZero(t, metadata.Timestamp)
+	}
+	metadata, err = getMetadata(resp.Items[3].Key)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{"source": "feed-a"}, metadata.Meta)
+	}
+	gofight.New().GET("/document/bulk-2/content").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, "second", r.Body.String())
+			assert.Equal(t, "text/plain", r.HeaderMap.Get("Content-Type"))
+		})
+
+	// Existing documents are not replaced.
+	gofight.New().POST("/documents/_bulk").
+		SetHeader(gofight.H{
+			"Content-Type": "application/x-ndjson",
+		}).
+		SetBody(`{"key": "bulk-1", "document": "again"}`).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			var resp ResponseType
+			if assert.NoError(t, json.Unmarshal([]byte(r.Body.String()), &resp)) && assert.Len(t, resp.Items, 1) {
+				assert.False(t, resp.Items[0].Ok)
+			}
+		})
+}
+
+func TestBulkTar(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	files := []struct {
+		name, content string
+	}{
+		{"reports/a.txt.meta.json", `{"key": "bulk-tar-1", "extractor": "test-extractor"}`},
+		{"reports/a.txt", "first file"},
+		{"reports/b.json", `{"b": 2}`},
+		{"orphan.txt.meta.json", `{}`},
+	}
+	for _, f := range files {
+		assert.NoError(t, w.WriteHeader(&tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.content))}))
+		w.Write([]byte(f.content))
+	}
+	assert.NoError(t, w.Close())
+
+	var resp ResponseType
+	gofight.New().POST("/documents/_bulk").
+		SetHeader(gofight.H{
+			"Content-Type": "application/x-tar",
+		}).
+		SetBody(buf.String()).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.NoError(t, json.Unmarshal([]byte(r.Body.String()), &resp))
+		})
+	if !assert.Len(t, resp.Items, 3) {
+		return
+	}
+	assert.True(t, resp.Items[0].Ok)
+	assert.True(t, resp.Items[1].Ok)
+	assert.False(t, resp.Items[2].Ok, "Sidecar without a file should fail")
+	defer cleanupDoc(t, resp.Items[0].Key)
+	defer cleanupDoc(t, resp.Items[1].Key)
+
+	assert.Equal(t, "bulk-tar-1", resp.Items[0].Key)
+	metadata, err := getMetadata("bulk-tar-1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a.txt", metadata.Name)
+		assert.Equal(t, testExtractor, metadata.Extractor)
+		assert.Contains(t, metadata.ContentType, "text/plain")
+	}
+	metadata, err = getMetadata(resp.Items[1].Key)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "b.json", metadata.Name)
+		assert.Equal(t, "application/json", metadata.ContentType)
+	}
+}
+
+func TestBulkUnsupported(t *testing.T) {
+	gofight.New().POST("/documents/_bulk").
+		SetHeader(gofight.H{
+			"Content-Type": "text/csv",
+		}).
+		SetBody("a,b").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnsupportedMediaType, r.Code)
+		})
+}
+
+func TestBulkDigests(t *testing.T) {
+	body := `{"key": "bulk-digest-1", "document": "first"}
+`
+	sum := md5.Sum([]byte(body))
+	zipped := testGzip(t, body)
+	for _, h := range []gofight.H{
+		{"Content-MD5": base64.StdEncoding.EncodeToString(make([]byte, md5.Size))},
+		{"Content-MD5": "not base64"},
+		{"Content-Encoding": "gzip", "Content-MD5": base64.StdEncoding.EncodeToString(sum[:])},
+	} {
+		h["Content-Type"] = "application/x-ndjson"
+		reqBody := body
+		if h["Content-Encoding"] != "" {
+			reqBody = zipped
+		}
+		gofight.New().POST("/documents/_bulk").
+			SetHeader(h).
+			SetBody(reqBody).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusBadRequest, r.Code, "%v", h)
+			})
+		_, err := getMetadata("bulk-digest-1")
+		assert.Equal(t, errKeyNotFound, err, "Nothing should be saved from a body failing its digest")
+	}
+
+	gofight.New().POST("/documents/_bulk").
+		SetHeader(gofight.H{
+			"Content-Type": "application/x-ndjson",
+			"Content-MD5":  base64.StdEncoding.EncodeToString(sum[:]),
+		}).
+		SetBody(body).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, "bulk-digest-1")
+	_, err := getMetadata("bulk-digest-1")
+	assert.NoError(t, err)
+}
+
+func TestBulkReadError(t *testing.T) {
+	body := `{"key": "bulk-failed-1", "document": "first"}
+{"key": "bulk-failed-2", "document": "second"}
+`
+	req := httptest.NewRequest("POST", "/documents/_bulk", &failingReader{[]byte(body)})
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var resp ResponseType
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp)) && assert.Len(t, resp.Items, 2) {
+		assert.False(t, resp.Items[0].Ok)
+		assert.False(t, resp.Items[1].Ok)
+	}
+	for _, key := range []string{"bulk-failed-1", "bulk-failed-2"} {
+		_, err := getMetadata(key)
+		assert.Equal(t, errKeyNotFound, err, "Documents not committed before the error should be discarded")
+	}
+	tmpFiles, err := filepath.Glob(dataDir + "/" + uploadPrefix + "*")
+	if assert.NoError(t, err) {
+		assert.Empty(t, tmpFiles, "Discarded documents should not leave files")
+	}
+}
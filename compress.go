@@ -0,0 +1,280 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// Content coding of contents compressed at rest, in DocMetadata.Encoding.
+const gzipEncoding = "gzip"
+
+// Suffix of the names of blobs and inline contents compressed at rest. They
+// differ from the uncompressed contents with the same digest, which other
+// documents may have.
+const gzipBlobSuffix = ".gz"
+
+// Compress text documents at rest.
+var compressAtRest bool
+
+// Compress the contents of a document written to a temporary file, if
+// compression at rest is enabled, they are text and compressing them saves
+// space. Records the coding in the metadata, and returns the path of the
+// file to store, removing the other one.
+func compressContents(metadata *DocMetadata, filePath string) (string, error) {
+	metadata.Encoding = ""
+	if !compressAtRest || !isTextContentType(metadata.ContentType) {
+		return filePath, nil
+	}
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile(dataDir, uploadPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = dst.Stat()
+	}
+	if err != nil || fi.Size() >= metadata.Size {
+		os.Remove(dst.Name())
+		return filePath, err
+	}
+	os.Remove(filePath)
+	metadata.Encoding = gzipEncoding
+	return dst.Name(), nil
+}
+
+// Open the contents of a document with a function opening them as stored,
+// decompressing them if they are compressed at rest.
+func decompressContents(metadata *DocMetadata, open func() (blobReader, error)) (blobReader, error) {
+	if metadata.Encoding != gzipEncoding {
+		return open()
+	}
+	r := &gunzipReader{open: open, size: metadata.Size}
+	if err := r.reset(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Contents compressed at rest, decompressed as they are read. Seeking
+// forward skips decompressed bytes, and seeking backward starts over, so
+// ranges are served without decompressing whole documents.
+type gunzipReader struct {
+	open func() (blobReader, error)
+	// Size of the decompressed contents.
+	size int64
+	// Position to read from.
+	off int64
+	// Position of the decompressed stream.
+	pos int64
+	src blobReader
+	zr  *gzip.Reader
+}
+
+// Start decompressing from the beginning.
+func (r *gunzipReader) reset() error {
+	r.Close()
+	src, err := r.open()
+	if err != nil {
+		return err
+	}
+	if r.zr == nil {
+		r.zr, err = gzip.NewReader(src)
+	} else {
+		err = r.zr.Reset(src)
+	}
+	if err != nil {
+		src.Close()
+		return err
+	}
+	r.src = src
+	r.pos = 0
+	return nil
+}
+
+func (r *gunzipReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.src == nil || r.pos > r.off {
+		if err := r.reset(); err != nil {
+			return 0, err
+		}
+	}
+	if r.pos < r.off {
+		n, err := io.CopyN(ioutil.Discard, r.zr, r.off-r.pos)
+		r.pos += n
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.zr.Read(p)
+	r.pos += int64(n)
+	r.off = r.pos
+	return n, err
+}
+
+func (r *gunzipReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *gunzipReader) Close() error {
+	if r.src == nil {
+		return nil
+	}
+	err := r.src.Close()
+	r.src = nil
+	return err
+}
+
+// Check if an Accept-Encoding header accepts gzip.
+func acceptsGzip(header string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != "gzip" && name != "x-gzip" && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+				q, _ = strconv.ParseFloat(v[2:], 64)
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+// Body of a request decompressed by decodeRequestBody.
+type gunzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b gunzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// Error reading a request body whose bytes, as sent, do not match the
+// digests given in its headers.
+type bodyDigestError struct {
+	err error
+}
+
+func (e bodyDigestError) Error() string {
+	return e.err.Error()
+}
+
+// Body of a request sent with a content coding, whose bytes as sent are
+// checked against the digests given in its headers once they are read.
+type digestedBody struct {
+	r        io.Reader
+	body     io.ReadCloser
+	hashes   contentHashes
+	expected map[string]string
+}
+
+func newDigestedBody(body io.ReadCloser, expected map[string]string) *digestedBody {
+	hashes := newContentHashes()
+	return &digestedBody{r: io.TeeReader(body, hashes.writer()), body: body, hashes: hashes, expected: expected}
+}
+
+func (b *digestedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		metadata := &DocMetadata{}
+		b.hashes.setDigests(metadata)
+		if err := checkDigests(metadata, b.expected); err != nil {
+			return n, bodyDigestError{err}
+		}
+	}
+	return n, err
+}
+
+func (b *digestedBody) Close() error {
+	return b.body.Close()
+}
+
+// Whether the body of a request is checked against digests by
+// decodeRequestBody once it is read.
+func digestedRequest(r *http.Request) bool {
+	b, ok := r.Body.(gunzipBody)
+	if !ok {
+		return false
+	}
+	_, ok = b.body.(*digestedBody)
+	return ok
+}
+
+// Decompress request bodies sent with Content-Encoding: gzip, so handlers
+// read what was uploaded before compression. Content-MD5 and Digest
+// headers are of the body as sent, so they are checked against the
+// compressed bytes instead of by the handlers. Other content codings get
+// 415 Unsupported Media Type.
+func decodeRequestBody(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		coding := strings.ToLower(strings.TrimSpace(r.Header.Get(echo.HeaderContentEncoding)))
+		switch coding {
+		case "", "identity":
+			return next(c)
+		case "gzip", "x-gzip":
+		default:
+			return c.JSON(statusUnsupportedMediaType, newErrorResp(c.Param("id"), "unsupported content encoding", fmt.Errorf("content encoding %s is not supported", coding)))
+		}
+		expected, err := expectedDigests(r.Header)
+		if err != nil {
+			return c.JSON(statusBadRequest, newErrorResp(c.Param("id"), "input error", err))
+		}
+		if len(expected) > 0 {
+			r.Body = newDigestedBody(r.Body, expected)
+			r.Header.Del("Content-MD5")
+			r.Header.Del("Digest")
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return c.JSON(statusBadRequest, newErrorResp(c.Param("id"), "invalid gzip body", err))
+		}
+		r.Body = gunzipBody{zr, r.Body}
+		r.Header.Del(echo.HeaderContentEncoding)
+		r.ContentLength = -1
+		return next(c)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const testCompressKey = "compress-123"
+
+// Compress contents with gzip.
+func testGzip(t *testing.T, content string) string {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	return buf.String()
+}
+
+func TestCompressedContents(t *testing.T) {
+	compressAtRest = true
+	defer func() { compressAtRest = false }()
+	content := strings.Repeat("some compressible plain text ", 100)
+
+	gofight.New().POST("/document/"+testCompressKey).
+		SetHeader(gofight.H{"Content-Type": "text/plain"}).
+		SetBody(content).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), testBlobDigest(content))
+		})
+	defer cleanupDoc(t, testCompressKey)
+	metadata, err := getMetadata(testCompressKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, gzipEncoding, metadata.Encoding)
+	assert.Equal(t, int64(len(content)), metadata.Size)
+	size, err := blobs.size(testBlobDigest(content) + gzipBlobSuffix)
+	if assert.NoError(t, err) {
+		assert.True(t, size < metadata.Size, "Contents should be compressed at rest")
+	}
+
+	gofight.New().GET("/document/"+testCompressKey).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), content)
+		})
+	gofight.New().GET("/document/"+testCompressKey+"/content").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Empty(t, r.HeaderMap.Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", r.HeaderMap.Get("Vary"))
+			assert.Equal(t, strconv.Itoa(len(content)), r.HeaderMap.Get("Content-Length"))
+			assert.Equal(t, content, r.Body.String())
+		})
+	gofight.New().GET("/document/"+testCompressKey+"/content").
+		SetHeader(gofight.H{"Accept-Encoding": "gzip, deflate"}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "gzip", r.HeaderMap.Get("Content-Encoding"))
+			assert.Equal(t, strconv.FormatInt(size, 10), r.HeaderMap.Get("Content-Length"))
+			zr, err := gzip.NewReader(r.Body)
+			if assert.NoError(t, err) {
+				b, err := ioutil.ReadAll(zr)
+				assert.NoError(t, err)
+				assert.Equal(t, content, string(b))
+			}
+		})
+	gofight.New().GET("/document/"+testCompressKey+"/content").
+		SetHeader(gofight.H{"Accept-Encoding": "gzip", "Range": "bytes=1000-1009,5-9"}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPartialContent, r.Code)
+			assert.Empty(t, r.HeaderMap.Get("Content-Encoding"), "Ranges should be of the decompressed contents")
+			assert.Contains(t, r.Body.String(), content[1000:1010])
+			assert.Contains(t, r.Body.String(), content[5:10])
+		})
+	gofight.New().GET("/search?q=compressible").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), testCompressKey)
+		})
+
+	// Compression is recorded per document, so documents saved without it
+	// are still read.
+	compressAtRest = false
+	gofight.New().PUT("/document/"+testCompressKey).
+		SetHeader(gofight.H{"Content-Type": "text/plain"}).
+		SetBody(content).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	assert.Len(t, testListBlobs(t, blobs), 2, "Compressed and uncompressed contents should be kept apart")
+	assert.Contains(t, testVersionContents(t, testCompressKey, 1), content)
+	f := &fsck{}
+	if assert.NoError(t, f.run()) {
+		assert.Empty(t, f.problems)
+	}
+}
+
+func TestResumeCompressedDownload(t *testing.T) {
+	compressAtRest = true
+	defer func() { compressAtRest = false }()
+	content := strings.Repeat("some compressible plain text ", 100)
+	gofight.New().POST("/document/"+testCompressKey).
+		SetHeader(gofight.H{"Content-Type": "text/plain"}).
+		SetBody(content).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testCompressKey)
+
+	etag := ""
+	gofight.New().GET("/document/"+testCompressKey+"/content").
+		SetHeader(gofight.H{"Accept-Encoding": "gzip"}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "gzip", r.HeaderMap.Get("Content-Encoding"))
+			etag = r.HeaderMap.Get("ETag")
+		})
+	assert.NotEqual(t, testETag(t, testCompressKey), etag, "Compressed contents should have their own ETag")
+	gofight.New().GET("/document/"+testCompressKey+"/content").
+		SetHeader(gofight.H{"Accept-Encoding": "gzip", "If-None-Match": etag}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotModified, r.Code)
+		})
+
+	// Ranges are of the decompressed contents, so resuming the compressed
+	// download gets the whole decompressed contents instead.
+	gofight.New().GET("/document/"+testCompressKey+"/content").
+		SetHeader(gofight.H{"Accept-Encoding": "gzip", "Range": "bytes=100-", "If-Range": etag}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Empty(t, r.HeaderMap.Get("Content-Encoding"))
+			assert.Equal(t, content, r.Body.String())
+		})
+	gofight.New().GET("/document/"+testCompressKey+"/content").
+		SetHeader(gofight.H{"Accept-Encoding": "gzip", "Range": "bytes=100-", "If-Range": testETag(t, testCompressKey)}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPartialContent, r.Code)
+			assert.Equal(t, content[100:], r.Body.String())
+		})
+}
+
+func TestGzipUpload(t *testing.T) {
+	gofight.New().POST("/document/"+testCompressKey).
+		SetHeader(gofight.H{"Content-Type": "text/plain", "Content-Encoding": "gzip"}).
+		SetBody(testGzip(t, testContent)).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), testBlobDigest(testContent))
+		})
+	gofight.New().GET("/document/"+testCompressKey+"/content").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, testContent, r.Body.String())
+		})
+	cleanupDoc(t, testCompressKey)
+
+	// Content-MD5 and Digest headers are of the compressed body as sent.
+	body := testGzip(t, testContent)
+	bodyMD5, bodySHA256 := md5.Sum([]byte(body)), sha256.Sum256([]byte(body))
+	contentMD5 := md5.Sum([]byte(testContent))
+	gofight.New().POST("/document/"+testCompressKey).
+		SetHeader(gofight.H{
+			"Content-Encoding": "gzip",
+			"Content-MD5":      base64.StdEncoding.EncodeToString(bodyMD5[:]),
+			"Digest":           "SHA-256=" + base64.StdEncoding.EncodeToString(bodySHA256[:]),
+		}).
+		SetBody(body).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), hex.EncodeToString(contentMD5[:]))
+		})
+	cleanupDoc(t, testCompressKey)
+	for _, header := range []gofight.H{
+		{"Content-MD5": base64.StdEncoding.EncodeToString(contentMD5[:])},
+		{"Digest": "MD5=" + base64.StdEncoding.EncodeToString(contentMD5[:])},
+	} {
+		header["Content-Encoding"] = "gzip"
+		gofight.New().POST("/document/"+testCompressKey).
+			SetHeader(header).
+			SetBody(body).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusBadRequest, r.Code)
+				assert.Contains(t, r.Body.String(), "digest mismatch")
+			})
+	}
+	gofight.New().GET("/document/"+testCompressKey+"/metadata").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotFound, r.Code, "Mismatching upload should not be stored")
+		})
+
+	gofight.New().POST("/document/"+testCompressKey).
+		SetHeader(gofight.H{"Content-Encoding": "gzip"}).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+			assert.Contains(t, r.Body.String(), "invalid gzip body")
+		})
+	gofight.New().POST("/document/"+testCompressKey).
+		SetHeader(gofight.H{"Content-Encoding": "br"}).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnsupportedMediaType, r.Code)
+		})
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, accepts := range map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, gzip;q=1.0": true,
+		"GZIP":                true,
+		"br, *":               true,
+		"gzip;q=0":            false,
+		"identity":            false,
+	} {
+		assert.Equal(t, accepts, acceptsGzip(header), header)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Get the entity tag of a document, which changes with its contents and
+// with every change to its metadata. Documents stored before digests were
+// computed use their timestamp instead.
+func docETag(metadata *DocMetadata) string {
+	digest := metadata.SHA256
+	if digest == "" {
+		digest = strconv.FormatInt(metadata.Timestamp, 16)
+	}
+	return fmt.Sprintf(`"%s-%d"`, digest, metadata.Revision)
+}
+
+// Get the entity tag of the contents of a document sent compressed as
+// stored, which differ from the decompressed contents with docETag, so a
+// download of one is not resumed with ranges of the other.
+func gzipETag(metadata *DocMetadata) string {
+	etag := docETag(metadata)
+	return etag[:len(etag)-1] + "-" + gzipEncoding + `"`
+}
+
+// Get the last modification time of a document or its metadata, or the zero
+// time if unknown.
+func lastModified(metadata *DocMetadata) time.Time {
+	t := metadata.Timestamp
+	if metadata.Updated > t {
+		t = metadata.Updated
+	}
+	if t <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(t, 0)
+}
+
+// Set the ETag and Last-Modified headers of a response about a document.
+func setValidators(h http.Header, metadata *DocMetadata) {
+	h.Set("ETag", docETag(metadata))
+	if t := lastModified(metadata); !t.IsZero() {
+		h.Set(echo.HeaderLastModified, t.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Check if an entity tag is in the list of an If-Match or If-None-Match
+// header. Weak tags are compared by their opaque tag unless strong is set.
+func etagListed(header, etag string, strong bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if strong {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a read request for a document can be answered with 304 Not
+// Modified, following If-None-Match, or If-Modified-Since without it.
+func notModified(r *http.Request, metadata *DocMetadata) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return etagListed(header, docETag(metadata), false)
+	}
+	since, err := http.ParseTime(r.Header.Get(echo.HeaderIfModifiedSince))
+	if err != nil {
+		return false
+	}
+	t := lastModified(metadata)
+	return !t.IsZero() && !t.After(since)
+}
+
+// Check an If-Match header against the current metadata of a document,
+// which is nil if there is no document. An empty header always matches.
+func ifMatch(header string, metadata *DocMetadata) error {
+	if header == "" {
+		return nil
+	}
+	if metadata == nil || !etagListed(header, docETag(metadata), true) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// Send a JSON response about a document, with its entity tag in the ETag
+// header when there is one, and the digests of its contents in the Digest
+// header when requested with Want-Digest.
+func docJSON(c echo.Context, code int, res *ResponseType) error {
+	if res.ETag != "" {
+		c.Response().Header().Set("ETag", res.ETag)
+	}
+	if want := c.Request().Header.Get("Want-Digest"); want != "" {
+		setDigestHeader(c.Response().Header(), want, &DocMetadata{MD5: res.MD5, SHA1: res.SHA1, SHA256: res.SHA256})
+	}
+	return c.JSON(code, res)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConditionalKey = "conditional-123"
+
+// Get the current ETag of a document.
+func testETag(t *testing.T, key string) string {
+	etag := ""
+	gofight.New().GET("/document/"+key+"/metadata").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			etag = r.HeaderMap.Get("ETag")
+		})
+	assert.NotEmpty(t, etag, "ETag should be set")
+	return etag
+}
+
+func TestConditionalGet(t *testing.T) {
+	gofight.New().POST("/document/"+testConditionalKey).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testConditionalKey)
+	etag := testETag(t, testConditionalKey)
+
+	for _, path := range []string{"", "/metadata", "/content"} {
+		gofight.New().GET("/document/"+testConditionalKey+path).
+			SetHeader(gofight.H{"If-None-Match": etag}).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusNotModified, r.Code, path)
+				assert.Empty(t, r.Body.String(), path)
+			})
+		gofight.New().GET("/document/"+testConditionalKey+path).
+			SetHeader(gofight.H{"If-None-Match": `"other"`}).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code, path)
+				assert.Equal(t, etag, r.HeaderMap.Get("ETag"), path)
+			})
+		gofight.New().GET("/document/"+testConditionalKey+path).
+			SetHeader(gofight.H{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusNotModified, r.Code, path)
+			})
+		gofight.New().GET("/document/"+testConditionalKey+path).
+			SetHeader(gofight.H{"If-Modified-Since": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code, path)
+			})
+	}
+}
+
+func TestConditionalWrite(t *testing.T) {
+	gofight.New().POST("/document/"+testConditionalKey).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testConditionalKey)
+	etag := testETag(t, testConditionalKey)
+
+	gofight.New().PATCH("/document/"+testConditionalKey+"/metadata").
+		SetHeader(gofight.H{"If-Match": `"stale-1"`}).
+		SetBody(`{"title": "new-title"}`).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPreconditionFailed, r.Code)
+		})
+	gofight.New().PATCH("/document/"+testConditionalKey+"/metadata").
+		SetHeader(gofight.H{"If-Match": etag}).
+		SetBody(`{"title": "new-title"}`).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.NotEqual(t, etag, r.HeaderMap.Get("ETag"), "ETag should change with the metadata")
+		})
+
+	// The metadata update made the first ETag stale.
+	gofight.New().PUT("/document/"+testConditionalKey).
+		SetHeader(gofight.H{"If-Match": etag}).
+		SetBody("replaced").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPreconditionFailed, r.Code)
+		})
+	etag = testETag(t, testConditionalKey)
+	gofight.New().PUT("/document/"+testConditionalKey).
+		SetHeader(gofight.H{"If-Match": etag}).
+		SetBody("replaced").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.NotEqual(t, etag, r.HeaderMap.Get("ETag"), "ETag should change with the contents")
+		})
+
+	gofight.New().DELETE("/document/"+testConditionalKey).
+		SetHeader(gofight.H{"If-Match": etag}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPreconditionFailed, r.Code)
+		})
+	gofight.New().DELETE("/document/"+testConditionalKey).
+		SetHeader(gofight.H{"If-Match": testETag(t, testConditionalKey)}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	gofight.New().POST("/document/"+testConditionalKey).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+}
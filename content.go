@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// Default content type for documents uploaded without one.
+const defaultContentType = "application/octet-stream"
+
+// Stream the raw document contents, without the JSON wrapping of getDoc.
+// The response carries the stored content type and metadata as HTTP
+// headers. HEAD requests get the same headers with no body. Byte ranges
+// (including multiple ranges and If-Range) are answered with 206 or 416,
+// so clients can resume or sample large documents. The ETag and
+// Last-Modified headers are honoured by conditional requests, with 304 or
+// 412 answers. The Digest header has the SHA-256 digest of the whole
+// document, or the digests requested with Want-Digest. Documents compressed
+// at rest are sent compressed to clients accepting gzip, with their own
+// ETag.
+func getDocContent(c echo.Context) error {
+	key := c.Param("id")
+	metadata, err := getMetadata(key)
+	if err == errKeyNotFound {
+		return c.JSON(statusNotFound, newErrorResp(key, "key not found", err))
+	}
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp(key, "error reading metadata", err))
+	}
+	// Contents compressed at rest are sent as stored to clients accepting
+	// gzip, unless they ask for ranges, which are of the decompressed
+	// contents.
+	open := openContents
+	compressed := metadata.Encoding == gzipEncoding && c.Request().Header.Get("Range") == "" && acceptsGzip(c.Request().Header.Get(echo.HeaderAcceptEncoding))
+	if compressed {
+		open = openStoredContents
+	}
+	f, err := open(key, metadata)
+	if _, ok := err.(keyUnavailableError); ok {
+		return c.JSON(statusErr, newErrorResp(key, "encryption key unavailable", err))
+	}
+	if err != nil {
+		return c.JSON(statusNotFound, newErrorResp(key, "key not found", err))
+	}
+	defer f.Close()
+	size, err := readerSize(f)
+	if err != nil || size <= 0 {
+		return c.JSON(statusNotFound, newErrorResp(key, "key not found", fmt.Errorf("no data for key %s", key)))
+	}
+
+	setContentHeaders(c.Response().Header(), key, metadata)
+	if metadata.Encoding == gzipEncoding {
+		c.Response().Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	}
+	if compressed {
+		// ServeContent leaves out the length of encoded contents.
+		c.Response().Header().Set(echo.HeaderContentEncoding, gzipEncoding)
+		c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(size, 10))
+		c.Response().Header().Set("ETag", gzipETag(metadata))
+	}
+	setDigestHeader(c.Response().Header(), c.Request().Header.Get("Want-Digest"), metadata)
+	http.ServeContent(c.Response(), c.Request(), "", lastModified(metadata), f)
+	return nil
+}
+
+// Set the headers describing a stored document on a raw content response.
+func setContentHeaders(h http.Header, key string, metadata *DocMetadata) {
+	contentType := metadata.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	h.Set(echo.HeaderContentType, contentType)
+	h.Set("ETag", docETag(metadata))
+	name := metadata.Name
+	if name == "" {
+		name = key
+	}
+	if disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name}); disposition != "" {
+		h.Set(echo.HeaderContentDisposition, disposition)
+	}
+}
+
+// Skip compressing raw content responses, which carry an exact Content-Length.
+func skipRawContent(c echo.Context) bool {
+	return c.Path() == "/document/:id/content"
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testContentKey  = "content-123"
+	testContentName = "report.txt"
+	testContent     = "some plain text content"
+)
+
+func TestGetDocContent(t *testing.T) {
+	r := gofight.New()
+	r.POST("/document/"+testContentKey).
+		SetQuery(gofight.H{
+			"name": testContentName,
+		}).
+		SetHeader(gofight.H{
+			"Content-Type": "text/plain",
+		}).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testContentKey)
+
+	r.GET("/document/"+testContentKey+"/content").
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, testContent, r.Body.String())
+			assert.Equal(t, "text/plain", r.HeaderMap.Get("Content-Type"))
+			assert.Equal(t, `attachment; filename=report.txt`, r.HeaderMap.Get("Content-Disposition"))
+			assert.Equal(t, "23", r.HeaderMap.Get("Content-Length"))
+			assert.NotEmpty(t, r.HeaderMap.Get("Last-Modified"))
+		})
+
+	r.HEAD("/document/"+testContentKey+"/content").
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Empty(t, r.Body.String())
+			assert.Equal(t, "23", r.HeaderMap.Get("Content-Length"))
+		})
+}
+
+func TestGetDocContentNotFound(t *testing.T) {
+	r := gofight.New()
+	r.GET("/document/missing-key/content").
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotFound, r.Code)
+		})
+}
+
+func TestGetDocContentRange(t *testing.T) {
+	r := gofight.New()
+	r.POST("/document/"+testContentKey).
+		SetHeader(gofight.H{
+			"Content-Type": "text/plain",
+		}).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testContentKey)
+
+	r.GET("/document/"+testContentKey+"/content").
+		SetHeader(gofight.H{
+			"Range": "bytes=5-9",
+		}).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPartialContent, r.Code)
+			assert.Equal(t, "plain", r.Body.String())
+			assert.Equal(t, "bytes 5-9/23", r.HeaderMap.Get("Content-Range"))
+		})
+
+	r.GET("/document/"+testContentKey+"/content").
+		SetHeader(gofight.H{
+			"Range": "bytes=0-3,-7",
+		}).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPartialContent, r.Code)
+			assert.Contains(t, r.HeaderMap.Get("Content-Type"), "multipart/byteranges")
+			assert.Contains(t, r.Body.String(), "some")
+			assert.Contains(t, r.Body.String(), "content")
+		})
+
+	r.GET("/document/"+testContentKey+"/content").
+		SetHeader(gofight.H{
+			"Range": "bytes=100-200",
+		}).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, r.Code)
+		})
+
+	// A stale If-Range validator gets the whole document.
+	r.GET("/document/"+testContentKey+"/content").
+		SetHeader(gofight.H{
+			"Range":    "bytes=5-9",
+			"If-Range": "Mon, 02 Jan 2006 15:04:05 GMT",
+		}).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, testContent, r.Body.String())
+		})
+}
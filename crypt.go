@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// Contents encrypted at rest start with encryptionMagic and a random nonce
+// prefix, followed by the contents in chunks of encryptionChunkSize bytes,
+// each sealed with AES-GCM. The nonce of a chunk is the prefix followed by
+// its index, and the last chunk, which is shorter and possibly empty, is
+// sealed with different additional data, so chunks cannot be reordered or
+// dropped. Chunks are decrypted as they are read, so ranges of large
+// documents are served without decrypting them whole.
+const (
+	encryptionMagic      = "DSE1"
+	encryptionPrefixSize = 8
+	encryptionHeaderSize = len(encryptionMagic) + encryptionPrefixSize
+	encryptionChunkSize  = 64 * 1024
+	// Size of the AES-GCM tag sealing each chunk.
+	encryptionTagSize = 16
+)
+
+// Additional data of the chunks of encrypted contents.
+var (
+	encryptionChunkData = []byte{0}
+	encryptionFinalData = []byte{1}
+)
+
+// Suffix of the names of blobs and inline contents encrypted at rest, after
+// the key id.
+const encryptedBlobSuffix = ".enc"
+
+// Data keyed with each key to derive the key naming the blobs it encrypts.
+var blobNameKeyData = []byte("blob names")
+
+// Key ids are used in blob names.
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var errCorruptEncryption = errors.New("corrupt encrypted contents")
+
+// Error opening contents encrypted with a key that is not in the keyring.
+type keyUnavailableError struct {
+	id string
+}
+
+func (e keyUnavailableError) Error() string {
+	return fmt.Sprintf("encryption key %s is not in the keyring", e.id)
+}
+
+// Keys for encryption at rest, by id, and the id of the key encrypting new
+// contents.
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+	// Keys of the keyed digests naming encrypted blobs, by key id.
+	nameKeys map[string][]byte
+}
+
+// Keyring file, in JSON, with keys in base64.
+type keyringFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+var (
+	// Path to the keyring file, or "" to store contents unencrypted.
+	keyringPath string
+	keysMu      sync.RWMutex
+	// Keyring in use, loaded from keyringPath.
+	keys *keyring
+)
+
+// Index the text of documents encrypted at rest for search, although the
+// index is not encrypted.
+var indexEncrypted bool
+
+// Load the keyring file. Keys are 16, 24 or 32 bytes long, for AES-128,
+// AES-192 or AES-256.
+func loadKeyring(filePath string) (*keyring, error) {
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var f keyringFile
+	if err = json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %s", filePath, err)
+	}
+	k := &keyring{current: f.Current, keys: map[string]cipher.AEAD{}, nameKeys: map[string][]byte{}}
+	for id, encoded := range f.Keys {
+		if !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("invalid key id %q in keyring %s", id, filePath)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s in keyring %s: %s", id, filePath, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s in keyring %s: %s", id, filePath, err)
+		}
+		if k.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(blobNameKeyData)
+		k.nameKeys[id] = mac.Sum(nil)
+	}
+	if k.keys[k.current] == nil {
+		return nil, fmt.Errorf("current key %q is not in keyring %s", k.current, filePath)
+	}
+	return k, nil
+}
+
+// Load the keyring file at keyringPath into use, if there is one.
+func reloadKeyring() error {
+	if keyringPath == "" {
+		return nil
+	}
+	k, err := loadKeyring(keyringPath)
+	if err != nil {
+		return err
+	}
+	keysMu.Lock()
+	keys = k
+	keysMu.Unlock()
+	return nil
+}
+
+// Get the id and cipher of the key encrypting new contents, or "" if
+// contents are stored unencrypted.
+func currentKey() (string, cipher.AEAD) {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	if keys == nil {
+		return "", nil
+	}
+	return keys.current, keys.keys[keys.current]
+}
+
+// Get the cipher of a key by id.
+func findKey(id string) (cipher.AEAD, error) {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	if keys == nil || keys.keys[id] == nil {
+		return nil, keyUnavailableError{id}
+	}
+	return keys.keys[id], nil
+}
+
+// Get the keyed digest naming the blob of contents with a SHA-256 digest
+// encrypted with a key, in hex. Unlike the digest itself, it does not tell
+// whether known contents are stored without the key.
+func blobDigest(id, digest string) (string, error) {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	if keys == nil || keys.nameKeys[id] == nil {
+		return "", keyUnavailableError{id}
+	}
+	mac := hmac.New(sha256.New, keys.nameKeys[id])
+	io.WriteString(mac, digest)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Check whether the text of a document is indexed for search. The index
+// holds the terms of documents in plaintext, enough to rebuild them, so
+// documents encrypted at rest are left out unless indexEncrypted is set.
+func indexesText(metadata *DocMetadata) bool {
+	return metadata.KeyID == "" || indexEncrypted
+}
+
+// Nonce of a chunk of encrypted contents.
+func chunkNonce(prefix []byte, index int64) []byte {
+	nonce := make([]byte, encryptionPrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], uint32(index))
+	return nonce
+}
+
+// Encrypt contents to a writer.
+func encrypt(w io.Writer, r io.Reader, aead cipher.AEAD) error {
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, encryptionMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	buf := make([]byte, encryptionChunkSize)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(r, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+		data := encryptionChunkData
+		if final {
+			data = encryptionFinalData
+		}
+		if _, err = w.Write(aead.Seal(nil, chunkNonce(prefix, index), buf[:n], data)); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// Encrypt the contents of a document in a temporary file with the current
+// key. Records the key in the metadata, and returns the path of the file to
+// store, removing the other one. Contents are left unencrypted if there is
+// no keyring.
+func encryptContents(metadata *DocMetadata, filePath string) (string, error) {
+	id, aead := currentKey()
+	metadata.KeyID = id
+	metadata.BlobDigest = ""
+	if aead == nil {
+		return filePath, nil
+	}
+	digest, err := blobDigest(id, metadata.SHA256)
+	if err != nil {
+		return "", err
+	}
+	metadata.BlobDigest = digest
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile(dataDir, uploadPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	err = encrypt(dst, src, aead)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	os.Remove(filePath)
+	return dst.Name(), nil
+}
+
+// Open the contents of a document with a function opening them as stored,
+// decrypting them if they are encrypted at rest.
+func decryptContents(metadata *DocMetadata, open func() (blobReader, error)) (blobReader, error) {
+	if metadata.KeyID == "" {
+		return open()
+	}
+	aead, err := findKey(metadata.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	src, err := open()
+	if err != nil {
+		return nil, err
+	}
+	r, err := newDecryptReader(src, aead)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Contents encrypted at rest, decrypted a chunk at a time as they are read.
+type decryptReader struct {
+	src    blobReader
+	aead   cipher.AEAD
+	prefix []byte
+	// Size of the decrypted contents.
+	size int64
+	// Index and size of the last chunk.
+	final     int64
+	finalSize int64
+	// Position to read from.
+	off int64
+	// Index of the chunk decrypted in buf, or -1.
+	chunk int64
+	buf   []byte
+}
+
+func newDecryptReader(src blobReader, aead cipher.AEAD) (*decryptReader, error) {
+	stored, err := readerSize(src)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptionHeaderSize)
+	if _, err = io.ReadFull(src, header); err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errCorruptEncryption
+	}
+	body := stored - int64(encryptionHeaderSize)
+	r := &decryptReader{
+		src:       src,
+		aead:      aead,
+		prefix:    header[len(encryptionMagic):],
+		final:     body / (encryptionChunkSize + encryptionTagSize),
+		finalSize: body % (encryptionChunkSize + encryptionTagSize),
+		chunk:     -1,
+	}
+	if r.finalSize < encryptionTagSize {
+		return nil, errCorruptEncryption
+	}
+	r.size = r.final*encryptionChunkSize + r.finalSize - encryptionTagSize
+	// An empty last chunk is never read, so it is checked now, or contents
+	// cut at a chunk boundary would be read as whole.
+	if r.finalSize == encryptionTagSize {
+		if err = r.load(r.final); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Decrypt a chunk into buf.
+func (r *decryptReader) load(index int64) error {
+	size, data := int64(encryptionChunkSize+encryptionTagSize), encryptionChunkData
+	if index == r.final {
+		size, data = r.finalSize, encryptionFinalData
+	}
+	if _, err := r.src.Seek(int64(encryptionHeaderSize)+index*(encryptionChunkSize+encryptionTagSize), io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.src, sealed); err != nil {
+		return err
+	}
+	buf, err := r.aead.Open(r.buf[:0], chunkNonce(r.prefix, index), sealed, data)
+	if err != nil {
+		r.chunk = -1
+		return errCorruptEncryption
+	}
+	r.buf, r.chunk = buf, index
+	return nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	index := r.off / encryptionChunkSize
+	if index != r.chunk {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[r.off-index*encryptionChunkSize:])
+	r.off += int64(n)
+	return n, nil
+}
+
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const testCryptKey = "crypt-123"
+
+// Write a keyring file with 256-bit keys derived from their ids.
+func writeTestKeyring(t *testing.T, filePath, current string, ids ...string) {
+	f := keyringFile{Current: current, Keys: map[string]string{}}
+	for _, id := range ids {
+		key := sha256.Sum256([]byte(id))
+		f.Keys[id] = base64.StdEncoding.EncodeToString(key[:])
+	}
+	b, err := json.Marshal(f)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filePath, b, 0600))
+}
+
+// Encrypt new contents with a test keyring file until the returned function
+// is called.
+func useTestKeyring(t *testing.T, current string, ids ...string) func() {
+	dir, err := ioutil.TempDir("", "keyring")
+	assert.NoError(t, err)
+	keyringPath = filepath.Join(dir, "keyring.json")
+	writeTestKeyring(t, keyringPath, current, ids...)
+	assert.NoError(t, reloadKeyring())
+	return func() {
+		keyringPath = ""
+		keys = nil
+		os.RemoveAll(dir)
+	}
+}
+
+// Get the name of the blob of contents encrypted with a key, with the
+// suffixes of the stored contents before encryption.
+func testEncryptedBlobName(t *testing.T, content, suffixes, id string) string {
+	digest, err := blobDigest(id, testBlobDigest(content))
+	assert.NoError(t, err)
+	return digest + suffixes + "." + id + encryptedBlobSuffix
+}
+
+// Read the stored contents of a blob.
+func testReadBlob(t *testing.T, name string) string {
+	r, err := blobs.open(name)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+// Decrypt contents as served, a known size at a time, and get the error.
+func testDecryptAll(sealed []byte, aead cipher.AEAD) error {
+	r, err := newDecryptReader(memoryBlobReader{bytes.NewReader(sealed)}, aead)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(ioutil.Discard, r, r.size)
+	return err
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "keyring.json")
+
+	writeTestKeyring(t, filePath, "k2", "k1", "k2")
+	k, err := loadKeyring(filePath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "k2", k.current)
+		assert.Len(t, k.keys, 2)
+	}
+
+	for _, invalid := range []string{
+		`not json`,
+		`{"current": "k1", "keys": {"k1": "not base64"}}`,
+		`{"current": "k1", "keys": {"k1": "c2hvcnQ="}}`,
+		`{"current": "k/1", "keys": {"k/1": "MDEyMzQ1Njc4OWFiY2RlZg=="}}`,
+		`{"current": "k2", "keys": {"k1": "MDEyMzQ1Njc4OWFiY2RlZg=="}}`,
+	} {
+		assert.NoError(t, ioutil.WriteFile(filePath, []byte(invalid), 0600))
+		_, err = loadKeyring(filePath)
+		assert.Error(t, err, invalid)
+	}
+	_, err = loadKeyring(filepath.Join(dir, "missing.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	defer useTestKeyring(t, "k1", "k1")()
+	_, aead := currentKey()
+	for _, size := range []int{0, 1, encryptionChunkSize, encryptionChunkSize + 1, 2*encryptionChunkSize + 5} {
+		content := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+		buf := &bytes.Buffer{}
+		if !assert.NoError(t, encrypt(buf, bytes.NewReader(content), aead)) {
+			continue
+		}
+		sealed := buf.Bytes()
+		r, err := newDecryptReader(memoryBlobReader{bytes.NewReader(sealed)}, aead)
+		if !assert.NoError(t, err, "size %d", size) {
+			continue
+		}
+		b, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, content, b, "size %d", size)
+		if size > 10 {
+			_, err = r.Seek(int64(size-10), io.SeekStart)
+			assert.NoError(t, err)
+			b, err = ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, content[size-10:], b, "size %d", size)
+		}
+
+		// Changed contents, and contents cut at a chunk boundary, are
+		// rejected.
+		tampered := append([]byte{}, sealed...)
+		tampered[len(tampered)-1] ^= 1
+		assert.Equal(t, errCorruptEncryption, testDecryptAll(tampered, aead), "size %d", size)
+		if size > encryptionChunkSize {
+			// Cut after the first chunk and the tag of the next one.
+			cut := sealed[:encryptionHeaderSize+encryptionChunkSize+2*encryptionTagSize]
+			assert.Equal(t, errCorruptEncryption, testDecryptAll(cut, aead), "size %d", size)
+		}
+	}
+	_, err := newDecryptReader(memoryBlobReader{bytes.NewReader([]byte("plain contents"))}, aead)
+	assert.Equal(t, errCorruptEncryption, err)
+}
+
+func TestEncryptedContents(t *testing.T) {
+	restore := useTestKeyring(t, "k1", "k1")
+	defer restore()
+	content := strings.Repeat("secret plain text ", 100)
+
+	gofight.New().POST("/document/"+testCryptKey).
+		SetHeader(gofight.H{"Content-Type": "text/plain"}).
+		SetBody(content).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), testBlobDigest(content))
+		})
+	defer cleanupDoc(t, testCryptKey)
+	metadata, err := getMetadata(testCryptKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "k1", metadata.KeyID)
+	assert.Equal(t, testEncryptedBlobName(t, content, "", "k1"), blobName(metadata))
+	assert.NotContains(t, blobName(metadata), testBlobDigest(content), "Blob names should not tell the digest of the contents")
+	stored := testReadBlob(t, blobName(metadata))
+	assert.NotContains(t, stored, "secret")
+
+	gofight.New().GET("/document/"+testCryptKey+"/content").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, content, r.Body.String())
+		})
+	gofight.New().GET("/document/"+testCryptKey+"/content").
+		SetHeader(gofight.H{"Range": "bytes=1000-1009"}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPartialContent, r.Code)
+			assert.Equal(t, content[1000:1010], r.Body.String())
+		})
+	gofight.New().GET("/search?q=secret").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.NotContains(t, r.Body.String(), testCryptKey, "Encrypted documents should not be indexed")
+		})
+	n, err := rebuildTextIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "Encrypted documents should not be reindexed")
+
+	// Compressed contents are encrypted after compression.
+	compressAtRest = true
+	gofight.New().PUT("/document/"+testCryptKey).
+		SetHeader(gofight.H{"Content-Type": "text/plain"}).
+		SetBody(content).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	compressAtRest = false
+	metadata, err = getMetadata(testCryptKey)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testEncryptedBlobName(t, content, gzipBlobSuffix, "k1"), blobName(metadata))
+		assert.True(t, int64(len(testReadBlob(t, blobName(metadata)))) < metadata.Size)
+	}
+	gofight.New().GET("/document/"+testCryptKey+"/content").
+		SetHeader(gofight.H{"Range": "bytes=5-9"}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPartialContent, r.Code)
+			assert.Equal(t, content[5:10], r.Body.String())
+		})
+	assert.Contains(t, testVersionContents(t, testCryptKey, 1), "secret plain text")
+	f := &fsck{}
+	if assert.NoError(t, f.run()) {
+		assert.Empty(t, f.problems)
+	}
+
+	// Contents encrypted with a key missing from the keyring are not read.
+	keys = nil
+	gofight.New().GET("/document/"+testCryptKey+"/content").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusInternalServerError, r.Code)
+			assert.Contains(t, r.Body.String(), "encryption key unavailable")
+			assert.NotContains(t, r.Body.String(), "secret")
+		})
+	gofight.New().GET("/document/"+testCryptKey).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusInternalServerError, r.Code)
+			assert.Contains(t, r.Body.String(), "encryption key unavailable")
+		})
+	assert.NoError(t, reloadKeyring())
+}
+
+func TestIndexEncrypted(t *testing.T) {
+	defer useTestKeyring(t, "k1", "k1")()
+	indexEncrypted = true
+	defer func() { indexEncrypted = false }()
+
+	gofight.New().POST("/document/"+testCryptKey).
+		SetHeader(gofight.H{"Content-Type": "text/plain"}).
+		SetBody("secret plain text").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testCryptKey)
+	gofight.New().GET("/search?q=secret").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), testCryptKey)
+			assert.Contains(t, r.Body.String(), `\u003cem\u003esecret\u003c/em\u003e`, "Snippets should be made")
+		})
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -13,9 +14,9 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	glog "github.com/labstack/gommon/log"
@@ -32,31 +33,77 @@ type DocMetadata struct {
 	Title            string `json:"title,omitempty"`
 	CreationDate     string `json:"creation-date,omitempty"`
 	ModificationDate string `json:"modification-date,omitempty"`
+	Updated          int64  `json:"updated,omitempty"`
+	Version          int    `json:"version,omitempty"`
+	// Number of times the metadata has been saved.
+	Revision int64 `json:"revision,omitempty"`
+	// Digests of the contents, in hex.
+	MD5    string `json:"md5,omitempty"`
+	SHA1   string `json:"sha1,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Size of the contents in bytes.
+	Size int64 `json:"size,omitempty"`
+	// Whether the contents are stored inline in the database.
+	Inline bool `json:"-"`
+	// Content coding of the stored contents, gzipEncoding if they are
+	// compressed at rest.
+	Encoding string `json:"-"`
+	// Id of the key the stored contents are encrypted with, if they are
+	// encrypted at rest.
+	KeyID string `json:"-"`
+	// Keyed digest of the contents naming their blob, in hex, if they are
+	// encrypted at rest.
+	BlobDigest string `json:"-"`
+	// User-defined metadata fields.
+	Meta map[string]string `json:"meta,omitempty"`
 }
 
 // ResponseType struct to send as json to client.
 type ResponseType struct {
-	Ok               bool   `json:"ok,string"`
-	Key              string `json:"key,omitempty"`
-	Message          string `json:"message,omitempty"`
-	Error            string `json:"error,omitempty"`
-	Document         string `json:"document,omitempty"`
-	Timestamp        int64  `json:"timestamp,omitempty"`
-	Name             string `json:"name,omitempty"`
-	ContentType      string `json:"content-type,omitempty"`
-	Extractor        string `json:"extractor,omitempty"`
-	Title            string `json:"title,omitempty"`
-	CreationDate     string `json:"creation-date,omitempty"`
-	ModificationDate string `json:"modification-date,omitempty"`
+	Ok               bool              `json:"ok,string"`
+	Key              string            `json:"key,omitempty"`
+	Message          string            `json:"message,omitempty"`
+	Error            string            `json:"error,omitempty"`
+	Document         string            `json:"document,omitempty"`
+	Timestamp        int64             `json:"timestamp,omitempty"`
+	Name             string            `json:"name,omitempty"`
+	ContentType      string            `json:"content-type,omitempty"`
+	Extractor        string            `json:"extractor,omitempty"`
+	Title            string            `json:"title,omitempty"`
+	CreationDate     string            `json:"creation-date,omitempty"`
+	ModificationDate string            `json:"modification-date,omitempty"`
+	Updated          int64             `json:"updated,omitempty"`
+	Version          int               `json:"version,omitempty"`
+	Revision         int64             `json:"revision,omitempty"`
+	ETag             string            `json:"etag,omitempty"`
+	MD5              string            `json:"md5,omitempty"`
+	SHA1             string            `json:"sha1,omitempty"`
+	SHA256           string            `json:"sha256,omitempty"`
+	Size             int64             `json:"size,omitempty"`
+	Meta             map[string]string `json:"meta,omitempty"`
+	Versions         []*DocMetadata    `json:"versions,omitempty"`
+	Documents        []*DocumentEntry  `json:"documents,omitempty"`
+	Next             string            `json:"next,omitempty"`
+	Results          []*SearchResult   `json:"results,omitempty"`
+	Total            int               `json:"total,omitempty"`
+	Items            []*ResponseType   `json:"items,omitempty"`
 }
 
 const (
 	// HTTP status code - OK
 	statusOk = http.StatusOK
+	// HTTP status code - BadRequest
+	statusBadRequest = http.StatusBadRequest
+	// HTTP status code - NotFound
+	statusNotFound = http.StatusNotFound
+	// HTTP status code - Conflict, used when a document already exists
+	statusConflict = http.StatusConflict
+	// HTTP status code - PreconditionFailed
+	statusPreconditionFailed = http.StatusPreconditionFailed
+	// HTTP status code - UnsupportedMediaType
+	statusUnsupportedMediaType = http.StatusUnsupportedMediaType
 	// HTTP status code - StatusInternalServerError
 	statusErr = http.StatusInternalServerError
-	// HTTP custom error code - FileExistsError
-	fileExistsErr = 515
 )
 
 const (
@@ -66,12 +113,41 @@ const (
 	dataDir = "data"
 	// Database file name.
 	dbFileName = "doc.db"
+	// Name prefix of the temporary files holding uploads in the data
+	// directory.
+	uploadPrefix = ".upload-"
 )
 
+// Error returned when there is no metadata record for a key.
+var errKeyNotFound = errors.New("key not found")
+
+// Error returned when a document does not match the If-Match header of a
+// request.
+var errPreconditionFailed = errors.New("document does not match If-Match")
+
+// Error returned when creating a document for a key that already has one.
+var errDocumentExists = errors.New("document exists")
+
 // Essentially constants.
 var (
 	// Database bucket to put metadata in.
 	dbBucket = []byte("DocMetadata")
+	// All database buckets, created on startup.
+	dbBuckets = [][]byte{
+		dbBucket,
+		versionsBucket,
+		extractorIndexBucket,
+		contentTypeIndexBucket,
+		timestampIndexBucket,
+		textPostingsBucket,
+		textDocsBucket,
+		textStatsBucket,
+		blobsBucket,
+		digestIndexBucket,
+		md5IndexBucket,
+		sha1IndexBucket,
+		inlineBucket,
+	}
 	// Database file path.
 	dbFilePath = path.Join(dataDir, dbFileName)
 )
@@ -81,25 +157,108 @@ var (
 	verbose bool
 	// Use GZIP compression.
 	useGzip bool
-	// Database instance.
-	db *bolt.DB
+	// Metadata store in use.
+	db metaStore
 )
 
 func main() {
 	port := flag.Int("port", defaultPort, "Port to start the server on")
 	flag.BoolVar(&verbose, "debug", false, "Show verbose output")
 	flag.BoolVar(&useGzip, "gzip", false, "Use gzip compression")
+	flag.BoolVar(&compressAtRest, "compress", false, "Compress text documents at rest")
+	flag.StringVar(&keyringPath, "keyring", "", "Keyring file with the keys to encrypt documents at rest")
+	flag.BoolVar(&indexEncrypted, "index-encrypted", false, "Index the text of encrypted documents for search, in plaintext")
+	storage := flag.String("storage", fsStorage, "Storage for document contents: fs, memory or s3")
+	metadata := flag.String("metadata", boltMetadata, "Store for document metadata: bolt or memory")
+	flag.Int64Var(&inlineThreshold, "inline-size", 0, "Store contents of up to this many bytes in the metadata database (0 to disable)")
+	var s3 s3Settings
+	flag.StringVar(&s3.endpoint, "s3-endpoint", "https://s3.amazonaws.com", "URL of the S3-compatible service")
+	flag.StringVar(&s3.bucket, "s3-bucket", "", "S3 bucket to store document contents in")
+	flag.StringVar(&s3.region, "s3-region", "us-east-1", "Region of the S3 bucket")
+	flag.StringVar(&s3.prefix, "s3-prefix", "", "Prefix of the names of the S3 objects")
 	flag.Parse()
+	// Credentials are kept out of the command line.
+	s3.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	s3.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	var err error
+	blobs, err = newBlobStore(*storage, s3)
+	if err != nil {
+		log.Fatalf("Unable to set up the storage: %s", err)
+	}
+	if err = reloadKeyring(); err != nil {
+		log.Fatalf("Unable to load the keyring: %s", err)
+	}
 
 	var e *echo.Echo
 	e = EchoEngine(*port)
 
-	err := os.MkdirAll(dataDir, 0777)
+	err = os.MkdirAll(dataDir, 0777)
 	if err != nil {
 		log.Fatalf("Unable to create the data directory %s\n", dataDir)
 	}
-	db = createDb(dbFilePath, dbBucket)
-	defer db.Close()
+	// The migration only moves files, without the database, so it runs
+	// while the service is up.
+	if flag.Arg(0) == "migrate" {
+		n, err := migrateLayout()
+		if err != nil {
+			log.Fatalf("Unable to migrate the data directory %s after moving %d files: %s", dataDir, n, err)
+		}
+		fmt.Printf("Moved %d files to the sharded layout\n", n)
+		return
+	}
+	// The running service holds the database, so it rotates the keys.
+	if flag.Arg(0) == "rotate-keys" {
+		n, err := requestKeyRotation(fmt.Sprintf("http://localhost:%d", *port))
+		if err != nil {
+			log.Fatalf("Unable to rotate keys after re-encrypting %d documents: %s", n, err)
+		}
+		fmt.Printf("Re-encrypted %d documents and versions with the current key\n", n)
+		return
+	}
+	db = createDb(*metadata, dbFilePath, dbBuckets...)
+	defer db.close()
+	err = indexExistingMetadata()
+	if err != nil {
+		log.Fatalf("Unable to index the metadata database %s: %s", dbFilePath, err)
+	}
+	// The database is locked, so no other process is uploading. The memory
+	// store has no lock, so its data directory must not be shared.
+	err = removeStaleUploads()
+	if err != nil {
+		log.Fatalf("Unable to remove interrupted uploads in %s: %s", dataDir, err)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "reindex":
+		n, err := rebuildTextIndex()
+		if err != nil {
+			log.Fatalf("Unable to rebuild the search index: %s", err)
+		}
+		fmt.Printf("Indexed %d documents for search\n", n)
+		return
+	case "fsck":
+		fsckFlags := flag.NewFlagSet("fsck", flag.ExitOnError)
+		f := &fsck{}
+		fsckFlags.BoolVar(&f.repair, "repair", false, "Repair the problems found")
+		fsckFlags.BoolVar(&f.rebuild, "rebuild", false, "Save orphan files as documents instead of quarantining them when repairing")
+		fsckFlags.Parse(flag.Args()[1:])
+		if err = f.run(); err != nil {
+			log.Fatalf("Unable to check %s: %s", dataDir, err)
+		}
+		for _, p := range f.problems {
+			fmt.Println(p)
+		}
+		n := f.unrepaired()
+		fmt.Printf("%d problems found, %d left unrepaired\n", len(f.problems), n)
+		if n > 0 {
+			db.close()
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command %s", flag.Arg(0))
+	}
 
 	graceful.ListenAndServe(e.Server, 5*time.Second)
 }
@@ -120,11 +279,14 @@ func EchoEngine(port int) (e *echo.Echo) {
 
 	if useGzip {
 		e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
-			Level: 5,
+			Skipper: skipRawContent,
+			Level:   5,
 		}))
 	}
 
 	e.Use(middleware.Recover())
+	e.Use(checkKeyParam)
+	e.Use(decodeRequestBody)
 
 	docRoutes := e.Group("/document")
 	// Get a document by the document id. Contents are returned in the
@@ -132,16 +294,64 @@ func EchoEngine(port int) (e *echo.Echo) {
 	// If there is a failure, the HTTP header and JSON response will
 	// indicate it.
 	docRoutes.GET("/:id", getDoc)
+	// Find documents by the MD5, SHA-1 or SHA-256 digest of their contents.
+	// JSON response includes the keys and metadata of the documents.
+	docRoutes.GET("/"+byHashKey+"/:algo/:digest", getDocsByHash)
+	// Get the raw contents of a document by the document id, with the
+	// metadata in the HTTP headers. HEAD returns the headers only.
+	docRoutes.GET("/:id/content", getDocContent)
+	docRoutes.HEAD("/:id/content", getDocContent)
+	// Get the metadata of a document without its contents.
+	docRoutes.GET("/:id/metadata", getDocMetadata)
+	// Update some of the metadata of a document with a JSON merge patch.
+	// The document contents are left untouched.
+	docRoutes.PATCH("/:id/metadata", patchDocMetadata)
+	// List the versions of a document. Replacing a document keeps the
+	// previous contents and metadata as an earlier version.
+	docRoutes.GET("/:id/versions", getDocVersions)
+	// Get a version of a document and its metadata.
+	docRoutes.GET("/:id/versions/:n", getDocVersion)
+	// Restore an earlier version of a document, as a new version.
+	docRoutes.POST("/:id/versions/:n/restore", restoreDocVersion)
 	// Add a new document, with an assigned id. JSON response indicates
 	// success or failure.
 	docRoutes.POST("", newDoc)
 	// Add a new document, passing an id. JSON response indicates success
 	// or failure.
 	docRoutes.POST("/:id", newDocWithID)
+	// Add or replace a document, passing an id. With "If-None-Match: *"
+	// an existing document is not replaced. JSON response indicates success
+	// or failure.
+	docRoutes.PUT("/:id", putDoc)
 	// Remove a document based on the id. JSON response indicates success
 	// or failure.
 	docRoutes.DELETE("/:id", deleteDoc)
 
+	docsRoutes := e.Group("/documents")
+	// List documents and their metadata, a page at a time. JSON response
+	// includes a continuation token for the next page.
+	docsRoutes.GET("", listDocs)
+	// Add many documents from a newline-delimited JSON or tar stream. JSON
+	// response has a result item per document.
+	docsRoutes.POST("/_bulk", bulkDocs)
+	// Get many documents and metadata by id. JSON response has a result
+	// item per id, and is streamed.
+	docsRoutes.POST("/_mget", multiGetDocs)
+	// Remove many documents by id. JSON response has a result item per id,
+	// and is streamed.
+	docsRoutes.POST("/_mdelete", multiDeleteDocs)
+
+	// Search the text of documents. JSON response includes the matching
+	// documents ranked by relevance, with highlighted snippets.
+	e.GET("/search", searchDocs)
+
+	// Reload the keyring and re-encrypt documents with its current key in
+	// the background. JSON response indicates whether it started.
+	e.POST("/keys/rotate", startKeyRotation)
+	// Get the progress of the key rotation. JSON response includes the
+	// number of documents re-encrypted so far.
+	e.GET("/keys/rotate", getKeyRotation)
+
 	e.Server.Addr = fmt.Sprintf(":%d", port)
 	e.Server.WriteTimeout = 90 * time.Second
 	e.Server.ReadTimeout = 60 * time.Second
@@ -149,176 +359,401 @@ func EchoEngine(port int) (e *echo.Echo) {
 	return e
 }
 
-// Create and return the bolt database for storing metadata.
-func createDb(f string, bucket []byte) *bolt.DB {
-	database, err := bolt.Open(f, 0600, &bolt.Options{Timeout: 5 * time.Second})
+// Create and return the metadata store of an implementation, with the
+// buckets for storing metadata.
+func createDb(name, f string, buckets ...[]byte) metaStore {
+	store, err := newMetaStore(name, f, buckets...)
 	if err != nil {
 		log.Fatalf("Unable to create the metadata database %s: %s", f, err)
 	}
-	err = database.Update(func(tx *bolt.Tx) error {
-		_, err2 := tx.CreateBucketIfNotExists(bucket)
-		if err2 != nil {
-			log.Fatalf("Unable to create the metadata database bucket %s: %s", bucket, err2)
-		}
-		return nil
-	})
-	if err != nil {
-		log.Fatalf("Unable to update the metadata database bucket %s: %s", bucket, err)
-	}
-	return database
+	return store
 }
 
 // Add metadata to the database.
 func saveMetadata(key string, metadata *DocMetadata) error {
-	buf := &bytes.Buffer{}
-	enc := gob.NewEncoder(buf)
-	err := enc.Encode(metadata)
+	err := updateBlobs(func(tx metaTx) error {
+		return putMetadata(tx, key, metadata)
+	})
+	return err
+}
+
+// Add metadata to the database within a transaction, keeping the secondary
+// indexes up to date. The revision of the metadata is set to follow the one
+// it replaces.
+func putMetadata(tx metaTx, key string, metadata *DocMetadata) error {
+	b := tx.bucket(dbBucket)
+	v := b.get([]byte(key))
+	// A record that cannot be decoded holds no blob reference.
+	old, err := decodeMetadata(v)
+	if err != nil {
+		old = nil
+	}
+	metadata.Revision = 1
+	if old != nil {
+		metadata.Revision = old.Revision + 1
+	}
+	buf, err := encodeMetadata(metadata)
 	if err != nil {
 		return err
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(dbBucket)
-		err2 := b.Put([]byte(key), buf.Bytes())
-		return err2
-	})
-	return err
+	if err = unindexMetadata(tx, key, v); err != nil {
+		return err
+	}
+	if err = moveBlobRef(tx, old, metadata); err != nil {
+		return err
+	}
+	if err = b.put([]byte(key), buf); err != nil {
+		return err
+	}
+	return indexMetadata(tx, key, metadata)
 }
 
 // Get metadata based on an id.
 func getMetadata(id string) (*DocMetadata, error) {
-	var metadata DocMetadata
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(dbBucket)
-		v := b.Get([]byte(id))
-		buf := bytes.NewBuffer(v)
-		dec := gob.NewDecoder(buf)
-		err := dec.Decode(&metadata)
+	var metadata *DocMetadata
+	err := db.view(func(tx metaTx) error {
+		var err error
+		metadata, err = decodeMetadata(tx.bucket(dbBucket).get([]byte(id)))
 		return err
 	})
+	return metadata, err
+}
+
+// Read, modify and write back the metadata for an id in a single
+// transaction, so concurrent updates cannot overwrite each other.
+func updateMetadata(id string, update func(*DocMetadata) error) (*DocMetadata, error) {
+	var metadata *DocMetadata
+	err := updateBlobs(func(tx metaTx) error {
+		b := tx.bucket(dbBucket)
+		var err error
+		metadata, err = decodeMetadata(b.get([]byte(id)))
+		if err != nil {
+			return err
+		}
+		if err = update(metadata); err != nil {
+			return err
+		}
+		return putMetadata(tx, id, metadata)
+	})
+	return metadata, err
+}
+
+// Encode metadata as a gob record.
+func encodeMetadata(metadata *DocMetadata) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := gob.NewEncoder(buf)
+	err := enc.Encode(metadata)
+	return buf.Bytes(), err
+}
+
+// Decode a gob metadata record. A missing record returns errKeyNotFound.
+func decodeMetadata(v []byte) (*DocMetadata, error) {
+	if v == nil {
+		return nil, errKeyNotFound
+	}
+	var metadata DocMetadata
+	dec := gob.NewDecoder(bytes.NewBuffer(v))
+	err := dec.Decode(&metadata)
 	return &metadata, err
 }
 
-// Delete metadata based on an id.
-func deleteMetadata(id string) error {
-	err := db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(dbBucket).Delete([]byte(id))
+// Delete metadata based on an id, releasing its reference to the contents.
+// A non-empty If-Match header is checked against the metadata first.
+func deleteMetadata(id, match string) error {
+	err := updateBlobs(func(tx metaTx) error {
+		b := tx.bucket(dbBucket)
+		v := b.get([]byte(id))
+		old, err := decodeMetadata(v)
+		if err != nil {
+			old = nil
+		}
+		if err = ifMatch(match, old); err != nil {
+			return err
+		}
+		if err = unindexMetadata(tx, id, v); err != nil {
+			return err
+		}
+		if err = moveBlobRef(tx, old, nil); err != nil {
+			return err
+		}
+		if err := unindexText(tx, id); err != nil {
+			return err
+		}
+		return b.delete([]byte(id))
 	})
 	return err
 }
 
-// Get a document and metadata.
+// Get a document and metadata. An unchanged document is not sent again to
+// a client that has it, following If-None-Match and If-Modified-Since.
 func getDoc(c echo.Context) error {
 	key := c.Param("id")
-	filePath := dataDir + "/" + key
-	fs, err := os.Stat(filePath)
-	if err != nil || fs.Size() <= 0 {
-		return c.JSON(statusErr, newErrorResp(key, "key not found", err))
-	}
-	f, err := os.Open(dataDir + "/" + key)
-	defer f.Close()
+	metadata, err := getMetadata(key)
 	if err != nil {
-		return c.JSON(statusErr, newErrorResp(key, "unable to open data", err))
+		return c.JSON(metadataError(key, err))
 	}
-	d, err := ioutil.ReadAll(f)
-	if err != nil {
-		return c.JSON(statusErr, newErrorResp(key, "error reading file", err))
+	setValidators(c.Response().Header(), metadata)
+	if notModified(c.Request(), metadata) {
+		return c.NoContent(http.StatusNotModified)
 	}
+	return c.JSON(readContents(key, metadata))
+}
 
+// Read a document and metadata into a response. Returns the HTTP status code
+// to send along with the response.
+func readDocument(key string) (int, *ResponseType) {
 	metadata, err := getMetadata(key)
 	if err != nil {
-		return c.JSON(statusErr, newErrorResp(key, "error reading metadata", err))
+		return metadataError(key, err)
 	}
-	r := newSuccessResp(key, "")
-	r.Timestamp = metadata.Timestamp
-	r.Name = metadata.Name
-	r.ContentType = metadata.ContentType
-	r.Extractor = metadata.Extractor
-	r.Title = metadata.Title
-	r.CreationDate = metadata.CreationDate
-	r.ModificationDate = metadata.ModificationDate
+	return readContents(key, metadata)
+}
+
+// Get the HTTP status code and response for a failure to read the metadata
+// of a document.
+func metadataError(key string, err error) (int, *ResponseType) {
+	if err == errKeyNotFound {
+		return statusErr, newErrorResp(key, "key not found", err)
+	}
+	return statusErr, newErrorResp(key, "error reading metadata", err)
+}
+
+// Read the contents of a document into a response along with its metadata.
+// Returns the HTTP status code to send along with the response.
+func readContents(key string, metadata *DocMetadata) (int, *ResponseType) {
+	f, err := openContents(key, metadata)
+	if _, ok := err.(keyUnavailableError); ok {
+		return statusErr, newErrorResp(key, "encryption key unavailable", err)
+	}
+	if err != nil {
+		return statusErr, newErrorResp(key, "key not found", err)
+	}
+	defer f.Close()
+	size, err := readerSize(f)
+	if err != nil || size <= 0 {
+		if err == nil {
+			err = fmt.Errorf("no data for key %s", key)
+		}
+		return statusErr, newErrorResp(key, "key not found", err)
+	}
+	d, err := ioutil.ReadAll(f)
+	if err != nil {
+		return statusErr, newErrorResp(key, "error reading file", err)
+	}
+
+	r := newMetadataResp(key, "", metadata)
 	r.Document = string(d)
 
-	return c.JSON(statusOk, r)
+	return statusOk, r
 }
 
 // Add a new document, creating a new v4 UUID.
 func newDoc(c echo.Context) error {
-	key := uuid.NewV4().String()
-	res := saveDocument(key, c)
-	if res.Ok == false {
-		if res.Message == "file exists" {
-			return c.JSON(fileExistsErr, res)
-		}
-		return c.JSON(statusErr, res)
-	}
-	return c.JSON(statusOk, res)
+	code, res := saveDocument("", c, false)
+	return docJSON(c, code, res)
 }
 
 // Add a new document, using the provided id.
 func newDocWithID(c echo.Context) error {
 	key := c.Param("id")
-	res := saveDocument(key, c)
-	if res.Ok == false {
-		return c.JSON(statusErr, res)
+	code, res := saveDocument(key, c, false)
+	return docJSON(c, code, res)
+}
+
+// Add or replace a document, using the provided id. The contents and
+// metadata are both replaced. With "If-None-Match: *" the document is only
+// created, and an existing document is left alone. With If-Match, the
+// document is only replaced if its ETag matches.
+func putDoc(c echo.Context) error {
+	key := c.Param("id")
+	if c.Request().Header.Get("If-None-Match") == "*" {
+		code, res := saveDocument(key, c, false)
+		if code == statusConflict {
+			code = statusPreconditionFailed
+		}
+		return docJSON(c, code, res)
 	}
-	return c.JSON(statusOk, res)
+	code, res := saveDocument(key, c, true)
+	return docJSON(c, code, res)
 }
 
-// Delete document from disk and metadata from database.
+// Delete document from disk and metadata from database. With If-Match, the
+// document is only removed if its ETag matches.
 func deleteDoc(c echo.Context) error {
-	key := c.Param("id")
-	err := os.Remove(dataDir + "/" + key)
+	return c.JSON(removeDocument(c.Param("id"), c.Request().Header.Get("If-Match")))
+}
+
+// Remove a document, its metadata and its versions, if it matches a
+// non-empty If-Match header. Returns the HTTP status code and response to
+// send.
+func removeDocument(key, match string) (int, *ResponseType) {
+	metadata, err := getMetadata(key)
+	if err != nil {
+		metadata = nil
+	}
+	if err = ifMatch(match, metadata); err != nil {
+		return statusPreconditionFailed, newErrorResp(key, "precondition failed", err)
+	}
+	// The contents of a document with a digest are released along with its
+	// metadata. Documents stored before that have a file of their own.
+	if metadata == nil || metadata.SHA256 == "" {
+		if err = retryMoved(func() string { return legacyPath(key) }, os.Remove); err != nil {
+			return statusErr, newErrorResp(key, "error removing document", err)
+		}
+	}
+	err = deleteMetadata(key, match)
+	if err == errPreconditionFailed {
+		return statusPreconditionFailed, newErrorResp(key, "precondition failed", err)
+	}
+	if err != nil {
+		return statusErr, newErrorResp(key, "error removing metadata", err)
+	}
+	err = deleteVersions(key)
+	if err != nil {
+		return statusErr, newErrorResp(key, "error removing versions", err)
+	}
+	return statusOk, newSuccessResp(key, "removed document")
+}
+
+// Save the document uploaded in a request, creating a new v4 UUID if no key
+// is given. A multipart/form-data request may upload several documents.
+// Returns the HTTP status code to send along with the response.
+func saveDocument(key string, c echo.Context, overwrite bool) (int, *ResponseType) {
+	r := c.Request()
+	if isMultipartUpload(r) {
+		return saveMultipartDocuments(key, c, overwrite)
+	}
+	defer r.Body.Close()
+	if key == "" {
+		key = uuid.NewV4().String()
+	}
+	values := r.URL.Query()
+	opts := uploadOptions(values, r.Header, overwrite)
+	digests, err := expectedDigests(r.Header)
 	if err != nil {
-		return c.JSON(statusErr, newErrorResp(key, "error removing document", err))
+		return statusBadRequest, newErrorResp(key, "input error", err)
+	}
+	opts.digests = digests
+	return storeDocument(key, r.Body, uploadMetadata(values, r.Header), opts)
+}
+
+// Options for saving a document.
+type saveOptions struct {
+	// Replace an existing document, keeping it as an earlier version.
+	overwrite bool
+	// Return the key of an existing document with the same contents instead
+	// of saving the document.
+	dedupe bool
+	// If-Match header the document being replaced must match, if not empty.
+	ifMatch string
+	// Digests the contents must have, in hex by name in hashAlgos.
+	digests map[string]string
+}
+
+// Save document to disk and metadata to database. An existing document is
+// only replaced if overwrite is set, and is then kept as an earlier version.
+// The contents are written to a temporary file first, so a replaced document
+// is never seen half written. Returns the HTTP status code to send along with
+// the response.
+func storeDocument(key string, body io.Reader, metadata *DocMetadata, opts saveOptions) (int, *ResponseType) {
+	doc, code, res := writeDocument(key, body, metadata, opts)
+	if doc == nil {
+		return code, res
 	}
-	err = deleteMetadata(key)
+	err := commitDocuments(doc)
 	if err != nil {
-		return c.JSON(statusErr, newErrorResp(key, "error removing metadata", err))
+		return statusErr, newErrorResp(key, "file metadata write error", fmt.Errorf("error saving metadata for key %s: %s", key, err.Error()))
 	}
-	return c.JSON(statusOk, newSuccessResp(key, "removed document"))
+	return doc.result(res)
 }
 
-// Save document to disk and metadata to database.
-func saveDocument(key string, c echo.Context) *ResponseType {
-	body := c.Request().Body
-	defer body.Close()
-	filePath := dataDir + "/" + key
-	fi, err := os.Stat(filePath)
-	if err == nil && fi.Size() > 0 {
-		return newErrorResp(key, "file exists", fmt.Errorf("file already exists for key %s", key))
+// Write document contents to a temporary file, computing their digests and
+// size, and checking the digests given in the options. A document whose
+// contents do not match is rejected, and its temporary file removed. The
+// document is left to be committed with commitDocuments. Returns the
+// pending document, or nil on failure, and the HTTP status code and
+// response to send.
+func writeDocument(key string, body io.Reader, metadata *DocMetadata, opts saveOptions) (*pendingDocument, int, *ResponseType) {
+	if err := validateKey(key); err != nil {
+		return nil, statusBadRequest, newErrorResp(key, "invalid key", err)
+	}
+	// Fail before reading the upload if the document exists. The check is
+	// repeated when committing, for documents created in the meantime.
+	if !opts.overwrite {
+		if _, err := getMetadata(key); err != errKeyNotFound {
+			return nil, statusConflict, newErrorResp(key, "file exists", fmt.Errorf("file already exists for key %s", key))
+		}
+		if fi, err := os.Stat(legacyPath(key)); err == nil && fi.Size() > 0 {
+			return nil, statusConflict, newErrorResp(key, "file exists", fmt.Errorf("file already exists for key %s", key))
+		}
 	}
-	f, err := os.Create(filePath)
+	f, err := ioutil.TempFile(dataDir, uploadPrefix)
 	if err != nil {
-		return newErrorResp(key, "file creation error", fmt.Errorf("error creating file for key %s: %s", key, err.Error()))
+		return nil, statusErr, newErrorResp(key, "file creation error", fmt.Errorf("error creating file for key %s: %s", key, err.Error()))
 	}
 	defer f.Close()
-	size, err := io.Copy(f, body)
+	// The temporary file is removed on failure, or once committed.
+	fail := func(code int, res *ResponseType) (*pendingDocument, int, *ResponseType) {
+		os.Remove(f.Name())
+		return nil, code, res
+	}
+	h := newContentHashes()
+	size, err := io.Copy(io.MultiWriter(f, h.writer()), body)
 	if size == 0 {
-		return newErrorResp("", "input error", fmt.Errorf("no data uploaded"))
+		return fail(statusBadRequest, newErrorResp("", "input error", fmt.Errorf("no data uploaded")))
+	}
+	if _, ok := err.(bodyDigestError); ok {
+		return fail(statusBadRequest, newErrorResp(key, "digest mismatch", err))
+	}
+	if err != nil {
+		return fail(statusErr, newErrorResp(key, "file write error", fmt.Errorf("error copying body to file for key %s: %s", key, err.Error())))
+	}
+	if err = f.Sync(); err != nil {
+		return fail(statusErr, newErrorResp(key, "file write error", fmt.Errorf("error syncing file for key %s: %s", key, err.Error())))
+	}
+	if err = f.Close(); err != nil {
+		return fail(statusErr, newErrorResp(key, "file write error", fmt.Errorf("error closing file for key %s: %s", key, err.Error())))
+	}
+	h.setDigests(metadata)
+	if err = checkDigests(metadata, opts.digests); err != nil {
+		return fail(statusBadRequest, newErrorResp(key, "digest mismatch", err))
+	}
+	metadata.Size = size
+	text, err := readIndexText(func() (blobReader, error) { return os.Open(f.Name()) }, metadata)
+	if err != nil {
+		return fail(statusErr, newErrorResp(key, "file write error", fmt.Errorf("error reading text to index for key %s: %s", key, err.Error())))
 	}
+	tmpPath, err := compressContents(metadata, f.Name())
 	if err != nil {
-		return newErrorResp(key, "file write error", fmt.Errorf("error copying body to file for key %s: %s", key, err.Error()))
-	}
-	name := c.Request().FormValue("name")
-	contentType := c.Request().Header.Get("Content-Type")
-	extractor := c.Request().FormValue("extractor")
-	title := c.Request().FormValue("dc:title")
-	creation := c.Request().FormValue("dcterms:created")
-	modification := c.Request().FormValue("dcterms:modified")
-	metadata := DocMetadata{
-		Timestamp:        time.Now().Unix(),
-		Name:             name,
-		ContentType:      contentType,
-		Extractor:        extractor,
-		Title:            title,
-		CreationDate:     creation,
-		ModificationDate: modification,
-	}
-	err = saveMetadata(key, &metadata)
+		return fail(statusErr, newErrorResp(key, "file write error", fmt.Errorf("error compressing file for key %s: %s", key, err.Error())))
+	}
+	encrypted, err := encryptContents(metadata, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fail(statusErr, newErrorResp(key, "file write error", fmt.Errorf("error encrypting file for key %s: %s", key, err.Error())))
+	}
+	tmpPath = encrypted
+	// The search index is not encrypted.
+	if !indexesText(metadata) {
+		text = nil
+	}
+	doc := &pendingDocument{key: key, metadata: metadata, text: text, tmpPath: tmpPath, overwrite: opts.overwrite, dedupe: opts.dedupe, ifMatch: opts.ifMatch}
+	return doc, statusOk, newSuccessResp(key, fmt.Sprintf("document saved (%d bytes)", size))
+}
+
+// Remove the temporary files of uploads interrupted by a crash. Their
+// documents were never committed. This must not run while uploading.
+func removeStaleUploads() error {
+	files, err := filepath.Glob(path.Join(dataDir, uploadPrefix+"*"))
 	if err != nil {
-		return newErrorResp(key, "file metadata write error", fmt.Errorf("error saving metadata for key %s: %s", key, err.Error()))
+		return err
 	}
-	return newSuccessResp(key, fmt.Sprintf("document saved (%d bytes)", size))
+	for _, f := range files {
+		if err = os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Create a new error response to send to client.
@@ -330,3 +765,30 @@ func newErrorResp(key, msg string, err error) *ResponseType {
 func newSuccessResp(key, msg string) *ResponseType {
 	return &ResponseType{Ok: true, Message: msg, Key: key}
 }
+
+// Set the digests and size of the contents of a document in a response.
+func setDigestFields(r *ResponseType, metadata *DocMetadata) {
+	r.MD5 = metadata.MD5
+	r.SHA1 = metadata.SHA1
+	r.SHA256 = metadata.SHA256
+	r.Size = metadata.Size
+}
+
+// Create a new success response carrying the document metadata.
+func newMetadataResp(key, msg string, metadata *DocMetadata) *ResponseType {
+	r := newSuccessResp(key, msg)
+	r.Timestamp = metadata.Timestamp
+	r.Name = metadata.Name
+	r.ContentType = metadata.ContentType
+	r.Extractor = metadata.Extractor
+	r.Title = metadata.Title
+	r.CreationDate = metadata.CreationDate
+	r.ModificationDate = metadata.ModificationDate
+	r.Updated = metadata.Updated
+	r.Version = metadata.Version
+	r.Revision = metadata.Revision
+	r.ETag = docETag(metadata)
+	setDigestFields(r, metadata)
+	r.Meta = metadata.Meta
+	return r
+}
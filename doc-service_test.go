@@ -2,14 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/appleboy/gofight"
-	"github.com/boltdb/bolt"
 	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 )
@@ -48,8 +51,8 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatalf("Unable to create the data directory %s\n", dataDir)
 	}
-	db = createDb(dbFilePath, dbBucket)
-	defer db.Close()
+	db = createDb(boltMetadata, dbFilePath, dbBuckets...)
+	defer db.close()
 	fmt.Printf("database created '%s'\n", dbFilePath)
 
 	// Run the tests.
@@ -141,11 +144,141 @@ func TestDeleteJSONDoc(t *testing.T) {
 		})
 }
 
+func TestPutDoc(t *testing.T) {
+	key := "put-123"
+	r := gofight.New()
+	r.PUT("/document/"+key).
+		SetQuery(gofight.H{
+			"dc:title": testTitle,
+		}).
+		SetBody(testJSON).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, key)
+
+	// A second POST must not overwrite the document.
+	r.POST("/document/"+key).
+		SetBody(`{"c": 3}`).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusConflict, r.Code)
+		})
+
+	// Neither may a create-only PUT.
+	r.PUT("/document/"+key).
+		SetHeader(gofight.H{
+			"If-None-Match": "*",
+		}).
+		SetBody(`{"c": 3}`).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPreconditionFailed, r.Code)
+		})
+
+	// A plain PUT replaces both the contents and the metadata.
+	r = gofight.New()
+	r.PUT("/document/"+key).
+		SetQuery(gofight.H{
+			"extractor": testExtractor,
+		}).
+		SetBody(`{"c": 3}`).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+
+	r.GET("/document/"+key).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.JSONEq(t, `{"c": 3}`, resp.Document)
+				assert.Equal(t, testExtractor, resp.Extractor, "Extractor metadata should match")
+				assert.Empty(t, resp.Title, "Title metadata should be replaced")
+			}
+		})
+}
+
+func TestConcurrentPost(t *testing.T) {
+	const key = "concurrent-123"
+	var wg sync.WaitGroup
+	codes := make([]int, 8)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			gofight.New().POST("/document/"+key).
+				SetBody(fmt.Sprintf("contents %d", i)).
+				Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+					codes[i] = r.Code
+				})
+		}(i)
+	}
+	wg.Wait()
+	defer cleanupDoc(t, key)
+
+	saved := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			saved++
+		} else {
+			assert.Equal(t, http.StatusConflict, code)
+		}
+	}
+	assert.Equal(t, 1, saved, "Only one upload should create the document")
+	versions, err := listVersions(key)
+	if assert.NoError(t, err) {
+		assert.Empty(t, versions, "No upload should replace another")
+	}
+}
+
+// Reader failing after some data has been read.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestFailedUpload(t *testing.T) {
+	const key = "failed-123"
+	code, _ := storeDocument(key, &failingReader{[]byte(testContent)}, &DocMetadata{}, saveOptions{})
+	assert.Equal(t, statusErr, code)
+	tmpFiles, err := filepath.Glob(dataDir + "/" + uploadPrefix + "*")
+	if assert.NoError(t, err) {
+		assert.Empty(t, tmpFiles, "Failed upload should not leave files")
+	}
+
+	gofight.New().POST("/document/"+key).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code, "Upload should be retried")
+		})
+	cleanupDoc(t, key)
+}
+
+func TestRemoveStaleUploads(t *testing.T) {
+	f, err := ioutil.TempFile(dataDir, uploadPrefix)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f.Close()
+	assert.NoError(t, removeStaleUploads())
+	_, err = os.Stat(f.Name())
+	assert.True(t, os.IsNotExist(err), "Stale upload should be removed")
+}
+
 func cleanupDoc(t *testing.T, key string) {
-	errFile := os.Remove(dataDir + "/" + key)
-	assert.NoError(t, errFile)
-	errDB := db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(dbBucket).Delete([]byte(key))
-	})
-	assert.NoError(t, errDB)
+	code, res := removeDocument(key, "")
+	assert.Equal(t, statusOk, code, res.Error)
 }
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directory in the data directory where fsck moves files it cannot account
+// for.
+const quarantineDir = ".quarantine"
+
+// A problem found by fsck in the data directory or the database.
+type fsckProblem struct {
+	// Kind of problem, such as "orphan file".
+	kind string
+	// Path of the file or key of the record with the problem.
+	name string
+	// Description of the problem.
+	detail string
+	// What was done to repair it, or "" if nothing was.
+	repair string
+}
+
+func (p *fsckProblem) String() string {
+	s := fmt.Sprintf("%s %s: %s", p.kind, p.name, p.detail)
+	if p.repair != "" {
+		s += " (" + p.repair + ")"
+	}
+	return s
+}
+
+// Checks the data directory against the metadata database, and optionally
+// repairs what it finds.
+type fsck struct {
+	// Fix the problems found.
+	repair bool
+	// Save orphan document files as documents with minimal metadata rather
+	// than quarantining them.
+	rebuild  bool
+	problems []*fsckProblem
+}
+
+// Record a problem, and repair it if repairing. A failed repair is noted in
+// the problem.
+func (f *fsck) report(kind, name, detail, repair string, fix func() error) {
+	p := &fsckProblem{kind: kind, name: name, detail: detail}
+	if f.repair && fix != nil {
+		if err := fix(); err != nil {
+			p.repair = "repair failed: " + err.Error()
+		} else {
+			p.repair = repair
+		}
+	}
+	f.problems = append(f.problems, p)
+}
+
+// Get the number of problems that were not repaired.
+func (f *fsck) unrepaired() int {
+	n := 0
+	for _, p := range f.problems {
+		if p.repair == "" || strings.HasPrefix(p.repair, "repair failed") {
+			n++
+		}
+	}
+	return n
+}
+
+// Metadata records read by fsck.
+type fsckRecords struct {
+	docs map[string]*DocMetadata
+	// Records that cannot be decoded.
+	undecodable []string
+	// Earlier versions, by key and version number.
+	versions map[string]map[int]*DocMetadata
+	// Earlier version records that cannot be decoded, by key.
+	undecodableVersions map[string][]int
+	// References to each blob, as stored.
+	blobRefs map[string]int64
+}
+
+// Read all metadata records.
+func readFsckRecords() (*fsckRecords, error) {
+	r := &fsckRecords{
+		docs:                map[string]*DocMetadata{},
+		versions:            map[string]map[int]*DocMetadata{},
+		undecodableVersions: map[string][]int{},
+		blobRefs:            map[string]int64{},
+	}
+	err := db.view(func(tx metaTx) error {
+		err := tx.bucket(dbBucket).forEach(func(k, v []byte) error {
+			metadata, err := decodeMetadata(v)
+			if err != nil {
+				r.undecodable = append(r.undecodable, string(k))
+				return nil
+			}
+			r.docs[string(k)] = metadata
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.bucket(versionsBucket).forEach(func(k, _ []byte) error {
+			key := string(k)
+			r.versions[key] = map[int]*DocMetadata{}
+			return tx.bucket(versionsBucket).bucket(k).forEach(func(vk, v []byte) error {
+				version := int(binary.BigEndian.Uint64(vk))
+				metadata, err := decodeMetadata(v)
+				if err != nil {
+					r.undecodableVersions[key] = append(r.undecodableVersions[key], version)
+					return nil
+				}
+				r.versions[key][version] = metadata
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return tx.bucket(blobsBucket).forEach(func(k, _ []byte) error {
+			r.blobRefs[string(k)] = getBlobRefs(tx, string(k))
+			return nil
+		})
+	})
+	return r, err
+}
+
+// Count the references to each blob from the metadata records.
+func (r *fsckRecords) expectedBlobRefs() map[string]int64 {
+	refs := map[string]int64{}
+	for _, metadata := range r.docs {
+		if metadata.SHA256 != "" {
+			refs[blobName(metadata)]++
+		}
+	}
+	for _, versions := range r.versions {
+		for _, metadata := range versions {
+			if metadata.SHA256 != "" {
+				refs[blobName(metadata)]++
+			}
+		}
+	}
+	return refs
+}
+
+// Get the sorted keys of a map of records.
+func sortedKeys(m map[string]*DocMetadata) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Check the data directory and the database. With repair set, problems are
+// fixed as they are found. The service must not be running.
+func (f *fsck) run() error {
+	if err := f.checkRecords(); err != nil {
+		return err
+	}
+	if err := f.checkFiles(); err != nil {
+		return err
+	}
+	return f.checkBlobs()
+}
+
+// Check that every metadata record can be decoded and has its contents.
+func (f *fsck) checkRecords() error {
+	r, err := readFsckRecords()
+	if err != nil {
+		return err
+	}
+	for _, key := range r.undecodable {
+		key := key
+		filePath := legacyPath(key)
+		if _, err := os.Stat(filePath); err == nil {
+			f.report("undecodable record", key, "metadata cannot be decoded", "rebuilt minimal metadata", func() error {
+				if err := deleteMetadata(key, ""); err != nil {
+					return err
+				}
+				return rebuildDocument(key, filePath)
+			})
+			continue
+		}
+		f.report("undecodable record", key, "metadata cannot be decoded and there is no file", "removed record", func() error {
+			return deleteMetadata(key, "")
+		})
+	}
+	for _, key := range sortedKeys(r.docs) {
+		key := key
+		metadata := r.docs[key]
+		size, err := contentsSize(key, metadata)
+		if os.IsNotExist(err) {
+			f.report("dangling record", key, "no contents "+contentsName(key, metadata), "removed record", func() error {
+				return deleteMetadata(key, "")
+			})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Compressed or encrypted contents differ in size from the metadata.
+		if metadata.Size > 0 && metadata.Encoding == "" && metadata.KeyID == "" && size != metadata.Size {
+			f.report("size mismatch", key, fmt.Sprintf("contents %s have %d bytes, metadata has %d", contentsName(key, metadata), size, metadata.Size), "", nil)
+		}
+	}
+
+	var keys []string
+	for key := range r.versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, version := range r.undecodableVersions[key] {
+			key, version := key, version
+			f.report("undecodable record", fmt.Sprintf("%s version %d", key, version), "metadata cannot be decoded", "removed record", func() error {
+				return deleteVersion(key, version)
+			})
+		}
+		var versions []int
+		for version := range r.versions[key] {
+			versions = append(versions, version)
+		}
+		sort.Ints(versions)
+		for _, version := range versions {
+			key, version := key, version
+			metadata := r.versions[key][version]
+			name := versionPath(key, version)
+			var err error
+			if metadata.SHA256 != "" {
+				name = contentsName(key, metadata)
+				_, err = contentsSize(key, metadata)
+			} else {
+				_, err = os.Stat(name)
+			}
+			if os.IsNotExist(err) {
+				f.report("dangling record", fmt.Sprintf("%s version %d", key, version), "no contents "+name, "removed record", func() error {
+					return deleteVersion(key, version)
+				})
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check that every file in the data directory, and every file of an earlier
+// version, belongs to a metadata record.
+func (f *fsck) checkFiles() error {
+	r, err := readFsckRecords()
+	if err != nil {
+		return err
+	}
+	// Files of documents and versions stored without a digest.
+	owned := map[string]bool{}
+	for key, metadata := range r.docs {
+		if metadata.SHA256 == "" {
+			owned[legacyPath(key)] = true
+		}
+	}
+	for key, versions := range r.versions {
+		for version, metadata := range versions {
+			if metadata.SHA256 == "" {
+				owned[versionPath(key, version)] = true
+			}
+		}
+	}
+
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || name == dbFileName || strings.HasPrefix(name, uploadPrefix) {
+			continue
+		}
+		f.checkDocFile(r, path.Join(dataDir, name), fi, owned)
+	}
+	err = walkFiles(path.Join(dataDir, keyDocsDir), func(filePath string, fi os.FileInfo) {
+		f.checkDocFile(r, filePath, fi, owned)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{versionsDir, keyVersionsDir} {
+		err = walkFiles(path.Join(dataDir, dir), func(filePath string, fi os.FileInfo) {
+			if owned[filePath] {
+				return
+			}
+			f.report("orphan file", filePath, "no version metadata record", "quarantined", func() error {
+				return quarantine(filePath)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that a file of a document stored under its key belongs to a
+// metadata record.
+func (f *fsck) checkDocFile(r *fsckRecords, filePath string, fi os.FileInfo, owned map[string]bool) {
+	if owned[filePath] {
+		return
+	}
+	name := fi.Name()
+	if f.rebuild && fi.Size() > 0 && validateKey(name) == nil {
+		if _, ok := r.docs[name]; !ok {
+			f.report("orphan file", filePath, "no metadata record", "rebuilt minimal metadata", func() error {
+				return rebuildDocument(name, filePath)
+			})
+			return
+		}
+	}
+	f.report("orphan file", filePath, "no metadata record", "quarantined", func() error {
+		return quarantine(filePath)
+	})
+}
+
+// Call a function for every file in a directory tree, if there is one.
+func walkFiles(dir string, fn func(string, os.FileInfo)) error {
+	err := filepath.Walk(dir, func(filePath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			fn(filePath, fi)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Check the reference counts of the blobs, and that every blob and all
+// inline contents are referenced.
+func (f *fsck) checkBlobs() error {
+	r, err := readFsckRecords()
+	if err != nil {
+		return err
+	}
+	expected := r.expectedBlobRefs()
+	var digests []string
+	for digest := range expected {
+		digests = append(digests, digest)
+	}
+	for digest := range r.blobRefs {
+		if _, ok := expected[digest]; !ok {
+			digests = append(digests, digest)
+		}
+	}
+	sort.Strings(digests)
+	mismatch := false
+	for _, digest := range digests {
+		if expected[digest] != r.blobRefs[digest] {
+			mismatch = true
+			f.report("reference count", digest, fmt.Sprintf("%d references stored, %d found", r.blobRefs[digest], expected[digest]), "", nil)
+		}
+	}
+	if mismatch && f.repair {
+		err = setBlobRefs(expected)
+		for _, p := range f.problems {
+			if p.kind != "reference count" {
+				continue
+			}
+			if err != nil {
+				p.repair = "repair failed: " + err.Error()
+			} else {
+				p.repair = "corrected"
+			}
+		}
+	}
+
+	err = blobs.list(func(digest string) error {
+		if expected[digest] == 0 {
+			f.report("orphan blob", digest, "not referenced by any metadata record", "quarantined", func() error {
+				return blobs.quarantine(digest)
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var orphans []string
+	err = db.view(func(tx metaTx) error {
+		return tx.bucket(inlineBucket).forEach(func(k, _ []byte) error {
+			if expected[string(k)] == 0 {
+				orphans = append(orphans, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, digest := range orphans {
+		digest := []byte(digest)
+		f.report("orphan inline contents", string(digest), "not referenced by any metadata record", "removed", func() error {
+			return db.update(func(tx metaTx) error {
+				return tx.bucket(inlineBucket).delete(digest)
+			})
+		})
+	}
+	return nil
+}
+
+// Describe where the contents of a document are, for reports.
+func contentsName(key string, metadata *DocMetadata) string {
+	if metadata.Inline {
+		return "inline " + blobName(metadata)
+	}
+	if metadata.SHA256 != "" {
+		return "blob " + blobName(metadata)
+	}
+	return legacyPath(key)
+}
+
+// Move a file in the data directory into the quarantine directory, keeping
+// its path relative to the data directory.
+func quarantine(filePath string) error {
+	rel, err := filepath.Rel(dataDir, filePath)
+	if err != nil {
+		return err
+	}
+	target := path.Join(dataDir, quarantineDir, rel)
+	if _, err = os.Stat(target); err == nil {
+		target += "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	if err = os.MkdirAll(path.Dir(target), 0777); err != nil {
+		return err
+	}
+	return os.Rename(filePath, target)
+}
+
+// Save a file found in the data directory as a document with minimal
+// metadata: its modification time, detected content type, digests and
+// size. The contents are moved into the blob store.
+func rebuildDocument(key, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	metadata := &DocMetadata{Timestamp: fi.ModTime().Unix(), ContentType: http.DetectContentType(head[:n])}
+	doc, _, res := writeDocument(key, f, metadata, saveOptions{overwrite: true})
+	if doc == nil {
+		return errors.New(res.Error)
+	}
+	if err = commitDocuments(doc); err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+// Find a problem reported by fsck.
+func findFsckProblem(f *fsck, kind, name string) *fsckProblem {
+	for _, p := range f.problems {
+		if p.kind == kind && p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func TestFsck(t *testing.T) {
+	for key, content := range map[string]string{"fsck-dangling": "dangling contents", "fsck-size": "size contents"} {
+		gofight.New().POST("/document/"+key).
+			SetBody(content).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+	}
+	defer cleanupDoc(t, "fsck-size")
+	assert.NoError(t, os.Remove(blobPath(testBlobDigest("dangling contents"))))
+	assert.NoError(t, ioutil.WriteFile(blobPath(testBlobDigest("size contents")), []byte("resized contents"), 0666))
+	orphanPath := path.Join(dataDir, "fsck-orphan")
+	assert.NoError(t, ioutil.WriteFile(orphanPath, []byte("orphan contents"), 0666))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dataDir, "fsck-undecodable"), []byte(testContent), 0666))
+	err := db.update(func(tx metaTx) error {
+		return tx.bucket(dbBucket).put([]byte("fsck-undecodable"), []byte("not gob"))
+	})
+	assert.NoError(t, err)
+	defer os.RemoveAll(path.Join(dataDir, quarantineDir))
+
+	f := &fsck{}
+	if assert.NoError(t, f.run()) {
+		assert.NotNil(t, findFsckProblem(f, "dangling record", "fsck-dangling"))
+		assert.NotNil(t, findFsckProblem(f, "size mismatch", "fsck-size"))
+		assert.NotNil(t, findFsckProblem(f, "orphan file", orphanPath))
+		assert.NotNil(t, findFsckProblem(f, "undecodable record", "fsck-undecodable"))
+		assert.Equal(t, len(f.problems), f.unrepaired(), "Nothing should be repaired")
+	}
+	_, err = os.Stat(orphanPath)
+	assert.NoError(t, err, "Checking should not move files")
+
+	f = &fsck{repair: true}
+	if assert.NoError(t, f.run()) {
+		assert.Equal(t, 1, f.unrepaired(), "Only the size mismatch should be left")
+	}
+	_, err = getMetadata("fsck-dangling")
+	assert.Equal(t, errKeyNotFound, err, "Dangling record should be removed")
+	_, err = os.Stat(orphanPath)
+	assert.True(t, os.IsNotExist(err), "Orphan file should be moved")
+	_, err = os.Stat(path.Join(dataDir, quarantineDir, "fsck-orphan"))
+	assert.NoError(t, err, "Orphan file should be quarantined")
+
+	gofight.New().GET("/document/fsck-undecodable/content").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, testContent, r.Body.String())
+			assert.Equal(t, "text/plain; charset=utf-8", r.HeaderMap.Get("Content-Type"))
+		})
+	cleanupDoc(t, "fsck-undecodable")
+}
+
+func TestFsckRebuild(t *testing.T) {
+	orphanPath := path.Join(dataDir, "fsck-rebuild")
+	assert.NoError(t, ioutil.WriteFile(orphanPath, []byte(testContent), 0666))
+	f := &fsck{repair: true, rebuild: true}
+	if assert.NoError(t, f.run()) {
+		p := findFsckProblem(f, "orphan file", orphanPath)
+		if assert.NotNil(t, p) {
+			assert.Equal(t, "rebuilt minimal metadata", p.repair)
+		}
+	}
+	defer cleanupDoc(t, "fsck-rebuild")
+	metadata, err := getMetadata("fsck-rebuild")
+	if assert.NoError(t, err) {
+		assert.Equal(t, testBlobDigest(testContent), metadata.SHA256)
+		assert.Equal(t, int64(len(testContent)), metadata.Size)
+	}
+	_, err = os.Stat(orphanPath)
+	assert.True(t, os.IsNotExist(err), "Contents should be moved into the blob store")
+}
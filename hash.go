@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// Index buckets on the MD5 and SHA-1 digests of the document contents. The
+// SHA-256 digest is indexed by the blob store.
+var (
+	// Index on DocMetadata.MD5.
+	md5IndexBucket = []byte("IdxMD5")
+	// Index on DocMetadata.SHA1.
+	sha1IndexBucket = []byte("IdxSHA1")
+)
+
+// Digest algorithm computed for every upload, with its metadata field and
+// index bucket.
+type hashAlgo struct {
+	new    func() hash.Hash
+	field  func(*DocMetadata) *string
+	bucket []byte
+}
+
+// Digest algorithms computed for every upload, by name.
+var hashAlgos = map[string]*hashAlgo{
+	"md5": {
+		new:    md5.New,
+		field:  func(m *DocMetadata) *string { return &m.MD5 },
+		bucket: md5IndexBucket,
+	},
+	"sha1": {
+		new:    sha1.New,
+		field:  func(m *DocMetadata) *string { return &m.SHA1 },
+		bucket: sha1IndexBucket,
+	},
+	"sha256": {
+		new:    sha256.New,
+		field:  func(m *DocMetadata) *string { return &m.SHA256 },
+		bucket: digestIndexBucket,
+	},
+}
+
+// Hashes of document contents by algorithm name, computed while the
+// contents are written.
+type contentHashes map[string]hash.Hash
+
+func newContentHashes() contentHashes {
+	h := contentHashes{}
+	for name, algo := range hashAlgos {
+		h[name] = algo.new()
+	}
+	return h
+}
+
+// Get a writer feeding all of the hashes.
+func (h contentHashes) writer() io.Writer {
+	var writers []io.Writer
+	for _, w := range h {
+		writers = append(writers, w)
+	}
+	return io.MultiWriter(writers...)
+}
+
+// Set the digests of the contents in the metadata of a document, in hex.
+func (h contentHashes) setDigests(metadata *DocMetadata) {
+	for name, w := range h {
+		*hashAlgos[name].field(metadata) = hex.EncodeToString(w.Sum(nil))
+	}
+}
+
+// Find the documents with contents matching a digest.
+func findDigestDocs(algo *hashAlgo, digest string) ([]*DocumentEntry, error) {
+	entries := []*DocumentEntry{}
+	err := db.view(func(tx metaTx) error {
+		b := tx.bucket(dbBucket)
+		prefix := stringIndexPrefix(digest)
+		ic := &indexCursor{c: tx.bucket(algo.bucket).cursor(), prefix: prefix, valueLen: len(prefix)}
+		for k, key := ic.seek(prefix); k != nil; k, key = ic.next() {
+			v := b.get(key)
+			if v == nil {
+				// Stale index entry.
+				continue
+			}
+			metadata, err := decodeMetadata(v)
+			if err != nil {
+				return fmt.Errorf("error reading metadata for key %s: %s", key, err)
+			}
+			entries = append(entries, &DocumentEntry{Key: string(key), DocMetadata: *metadata})
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Get the keys and metadata of the documents whose contents have an MD5,
+// SHA-1 or SHA-256 digest, given in hex.
+func getDocsByHash(c echo.Context) error {
+	name := strings.ToLower(c.Param("algo"))
+	digest := strings.ToLower(c.Param("digest"))
+	algo, ok := hashAlgos[name]
+	if !ok {
+		return c.JSON(statusBadRequest, newErrorResp("", "invalid hash algorithm", fmt.Errorf("unknown hash algorithm %s", c.Param("algo"))))
+	}
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != algo.new().Size() {
+		return c.JSON(statusBadRequest, newErrorResp("", "invalid digest", fmt.Errorf("%s is not a hex %s digest", c.Param("digest"), name)))
+	}
+	entries, err := findDigestDocs(algo, digest)
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp("", "error reading metadata", err))
+	}
+	if len(entries) == 0 {
+		return c.JSON(statusNotFound, newErrorResp("", "no document found", fmt.Errorf("no document with %s digest %s", name, digest)))
+	}
+	r := newSuccessResp("", "")
+	r.Documents = entries
+	return c.JSON(statusOk, r)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const testHashContent = "malicious sample"
+
+func TestGetDocsByHash(t *testing.T) {
+	for _, key := range []string{"hash-1", "hash-2"} {
+		gofight.New().POST("/document/"+key).
+			SetQuery(gofight.H{"extractor": testExtractor}).
+			SetBody(testHashContent).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+		defer cleanupDoc(t, key)
+	}
+	md5Sum := md5.Sum([]byte(testHashContent))
+	sha1Sum := sha1.Sum([]byte(testHashContent))
+	digests := map[string]string{
+		"md5":    hex.EncodeToString(md5Sum[:]),
+		"SHA1":   hex.EncodeToString(sha1Sum[:]),
+		"sha256": testBlobDigest(testHashContent),
+	}
+
+	for algo, digest := range digests {
+		gofight.New().GET("/document/by-hash/"+algo+"/"+digest).
+			SetDebug(true).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+				var resp ResponseType
+				err := json.Unmarshal([]byte(r.Body.String()), &resp)
+				if assert.NoError(t, err) && assert.Len(t, resp.Documents, 2) {
+					assert.Equal(t, "hash-1", resp.Documents[0].Key)
+					assert.Equal(t, "hash-2", resp.Documents[1].Key)
+					assert.Equal(t, testExtractor, resp.Documents[0].Extractor, "Metadata should be returned")
+					assert.Equal(t, digests["md5"], resp.Documents[0].MD5)
+					assert.Equal(t, digests["SHA1"], resp.Documents[0].SHA1)
+				}
+			})
+	}
+
+	gofight.New().GET("/document/by-hash/md5/"+testBlobDigest("other")[:32]).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotFound, r.Code)
+		})
+	gofight.New().GET("/document/by-hash/md5/"+digests["sha256"]).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		})
+	gofight.New().GET("/document/by-hash/crc32/"+digests["md5"]).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		})
+}
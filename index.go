@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"strings"
+)
+
+// Database buckets holding the secondary indexes on document metadata. The
+// index keys are the indexed value followed by the document key, with empty
+// values.
+var (
+	// Index on DocMetadata.Extractor.
+	extractorIndexBucket = []byte("IdxExtractor")
+	// Index on the media type of DocMetadata.ContentType, without parameters.
+	contentTypeIndexBucket = []byte("IdxContentType")
+	// Index on DocMetadata.Timestamp.
+	timestampIndexBucket = []byte("IdxTimestamp")
+)
+
+// Separator between a string value and the document key in an index key.
+const indexSep = 0
+
+// Get the index key prefix for a string value.
+func stringIndexPrefix(value string) []byte {
+	return append([]byte(value), indexSep)
+}
+
+// Get the index key prefix for a timestamp, which sorts in time order.
+func timestampIndexPrefix(timestamp int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(timestamp))
+	return k
+}
+
+// Normalize a content type to the media type used in the index, so
+// "text/plain; charset=utf-8" is found as "text/plain".
+func indexContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mediaType
+}
+
+// Get the index entries for the metadata of a document, by index bucket.
+func indexEntries(key string, metadata *DocMetadata) map[string][]byte {
+	entries := map[string][]byte{
+		string(timestampIndexBucket): append(timestampIndexPrefix(metadata.Timestamp), key...),
+	}
+	if metadata.Extractor != "" {
+		entries[string(extractorIndexBucket)] = append(stringIndexPrefix(metadata.Extractor), key...)
+	}
+	if contentType := indexContentType(metadata.ContentType); contentType != "" {
+		entries[string(contentTypeIndexBucket)] = append(stringIndexPrefix(contentType), key...)
+	}
+	for _, algo := range hashAlgos {
+		if digest := *algo.field(metadata); digest != "" {
+			entries[string(algo.bucket)] = append(stringIndexPrefix(digest), key...)
+		}
+	}
+	return entries
+}
+
+// Add the index entries for the metadata of a document.
+func indexMetadata(tx metaTx, key string, metadata *DocMetadata) error {
+	for bucket, k := range indexEntries(key, metadata) {
+		if err := tx.bucket([]byte(bucket)).put(k, []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the index entries for a stored metadata record, if there is one.
+// Records that cannot be decoded have no index entries to remove.
+func unindexMetadata(tx metaTx, key string, v []byte) error {
+	if v == nil {
+		return nil
+	}
+	metadata, err := decodeMetadata(v)
+	if err != nil {
+		return nil
+	}
+	for bucket, k := range indexEntries(key, metadata) {
+		if err := tx.bucket([]byte(bucket)).delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Index metadata stored before the indexes existed. Every document has a
+// timestamp index entry, so an empty timestamp index next to stored
+// metadata means the metadata has not been indexed yet.
+func indexExistingMetadata() error {
+	return db.update(func(tx metaTx) error {
+		if k, _ := tx.bucket(timestampIndexBucket).cursor().first(); k != nil {
+			return nil
+		}
+		return tx.bucket(dbBucket).forEach(func(k, v []byte) error {
+			metadata, err := decodeMetadata(v)
+			if err != nil {
+				return nil
+			}
+			return indexMetadata(tx, string(k), metadata)
+		})
+	})
+}
+
+// Cursor over the documents in an index with keys starting with a prefix.
+// It returns the index key and the document key of each entry.
+type indexCursor struct {
+	c      metaCursor
+	prefix []byte
+	// Length of the indexed value in each index key.
+	valueLen int
+	// Whether the indexed values are timestamps.
+	timestamps bool
+}
+
+// Get the first entry at or after seek, or nil at the end of the index.
+func (ic *indexCursor) seek(seek []byte) ([]byte, []byte) {
+	return ic.entry(ic.c.seek(seek))
+}
+
+// Get the next entry, or nil at the end of the index.
+func (ic *indexCursor) next() ([]byte, []byte) {
+	return ic.entry(ic.c.next())
+}
+
+func (ic *indexCursor) entry(k, _ []byte) ([]byte, []byte) {
+	if k == nil || !bytes.HasPrefix(k, ic.prefix) || len(k) < ic.valueLen {
+		return nil, nil
+	}
+	return k, k[ic.valueLen:]
+}
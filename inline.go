@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+)
+
+// Database bucket holding the contents of small documents, keyed by SHA-256
+// digest. They are saved in the transaction saving the metadata referring to
+// them, and share the reference counts of blobs, so they are removed in the
+// transaction removing their last reference.
+var inlineBucket = []byte("Inline")
+
+// Largest size in bytes of contents stored inline in the database instead of
+// the blob store, or 0 to store all contents in the blob store.
+var inlineThreshold int64
+
+// Decide where the contents of a document are stored, before the
+// transaction committing it: inline if they are small enough, otherwise in
+// the blob store, where they are uploaded now. Records where they are in the
+// metadata. Returns the function to call once the transaction is done, or
+// nil for inline contents.
+func uploadContents(doc *pendingDocument) (func(), error) {
+	doc.metadata.Inline = inlineThreshold > 0 && doc.metadata.Size <= inlineThreshold
+	if doc.metadata.Inline {
+		return nil, nil
+	}
+	return uploadBlob(blobName(doc.metadata), doc.tmpPath)
+}
+
+// Store the inline contents of a document, prepared with uploadContents,
+// within the transaction committing it.
+func putContents(tx metaTx, doc *pendingDocument) error {
+	if !doc.metadata.Inline {
+		return nil
+	}
+	name := blobName(doc.metadata)
+	b := tx.bucket(inlineBucket)
+	if b.get([]byte(name)) != nil {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(doc.tmpPath)
+	if err != nil {
+		return err
+	}
+	return b.put([]byte(name), contents)
+}
+
+// Get the inline contents with a name given by blobName. Missing contents
+// give os.ErrNotExist.
+func getInline(name string) ([]byte, error) {
+	var contents []byte
+	err := db.view(func(tx metaTx) error {
+		v := tx.bucket(inlineBucket).get([]byte(name))
+		if v == nil {
+			return os.ErrNotExist
+		}
+		contents = append([]byte{}, v...)
+		return nil
+	})
+	return contents, err
+}
+
+// Open the inline contents with a name given by blobName.
+func openInline(name string) (blobReader, error) {
+	contents, err := getInline(name)
+	if err != nil {
+		return nil, err
+	}
+	return memoryBlobReader{bytes.NewReader(contents)}, nil
+}
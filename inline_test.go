@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const testInlineKey = "inline-123"
+
+// Check whether contents are stored inline.
+func testHasInline(t *testing.T, digest string) bool {
+	_, err := getInline(digest)
+	if err != nil && !os.IsNotExist(err) {
+		assert.NoError(t, err)
+	}
+	return err == nil
+}
+
+func TestInlineContents(t *testing.T) {
+	saved := inlineThreshold
+	inlineThreshold = int64(len(testContent))
+	defer func() { inlineThreshold = saved }()
+
+	gofight.New().POST("/document/"+testInlineKey).
+		SetHeader(gofight.H{"Content-Type": "text/plain"}).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	digest := testBlobDigest(testContent)
+	assert.True(t, testHasInline(t, digest), "Small contents should be inline")
+	_, err := blobs.size(digest)
+	assert.True(t, os.IsNotExist(err), "Inline contents should not be in the blob store")
+
+	gofight.New().GET("/document/"+testInlineKey).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), testContent)
+		})
+	gofight.New().GET("/document/"+testInlineKey+"/content").
+		SetHeader(gofight.H{"Range": "bytes=5-9"}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPartialContent, r.Code)
+			assert.Equal(t, testContent[5:10], r.Body.String())
+		})
+	gofight.New().GET("/search?q=plain").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), testInlineKey)
+		})
+
+	large := strings.Repeat("large ", len(testContent))
+	gofight.New().PUT("/document/"+testInlineKey).
+		SetBody(large).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	_, err = blobs.size(testBlobDigest(large))
+	assert.NoError(t, err, "Large contents should be in the blob store")
+	assert.False(t, testHasInline(t, testBlobDigest(large)))
+	assert.True(t, testHasInline(t, digest), "Earlier version should keep its inline contents")
+	assert.Contains(t, testVersionContents(t, testInlineKey, 1), testContent)
+
+	f := &fsck{}
+	if assert.NoError(t, f.run()) {
+		assert.Empty(t, f.problems)
+	}
+
+	cleanupDoc(t, testInlineKey)
+	assert.False(t, testHasInline(t, digest), "Inline contents should be removed with the document")
+}
+
+func TestFsckInline(t *testing.T) {
+	digest := testBlobDigest("orphan")
+	err := db.update(func(tx metaTx) error {
+		return tx.bucket(inlineBucket).put([]byte(digest), []byte("orphan"))
+	})
+	assert.NoError(t, err)
+	f := &fsck{repair: true}
+	if assert.NoError(t, f.run()) {
+		p := findFsckProblem(f, "orphan inline contents", digest)
+		if assert.NotNil(t, p) {
+			assert.Equal(t, "removed", p.repair)
+		}
+	}
+	assert.False(t, testHasInline(t, digest))
+}
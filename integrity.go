@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Names of the digest algorithms in Digest and Want-Digest headers (RFC
+// 3230, RFC 5843), by name in hashAlgos.
+var instanceDigestNames = map[string]string{
+	"md5":    "MD5",
+	"sha1":   "SHA",
+	"sha256": "SHA-256",
+}
+
+// Get the name in hashAlgos of a digest algorithm in a Digest or
+// Want-Digest header, or "" if it is not computed for uploads.
+func instanceDigestAlgo(name string) string {
+	for algo, n := range instanceDigestNames {
+		if strings.EqualFold(n, name) {
+			return algo
+		}
+	}
+	return ""
+}
+
+// Get the digests an upload is expected to have, in hex by name in
+// hashAlgos, from Content-MD5 (RFC 1864) and Digest headers. Algorithms that
+// are not computed for uploads are ignored.
+func expectedDigests(header http.Header) (map[string]string, error) {
+	digests := map[string]string{}
+	add := func(algo, value, name string) error {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(b) != hashAlgos[algo].new().Size() {
+			return fmt.Errorf("invalid %s digest %s", name, value)
+		}
+		digest := hex.EncodeToString(b)
+		if other, ok := digests[algo]; ok && other != digest {
+			return fmt.Errorf("conflicting %s digests", name)
+		}
+		digests[algo] = digest
+		return nil
+	}
+	if v := header.Get("Content-MD5"); v != "" {
+		if err := add("md5", v, "Content-MD5"); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range header["Digest"] {
+		for _, d := range strings.Split(v, ",") {
+			i := strings.Index(d, "=")
+			if i < 0 {
+				return nil, fmt.Errorf("invalid digest %s", strings.TrimSpace(d))
+			}
+			name := strings.TrimSpace(d[:i])
+			algo := instanceDigestAlgo(name)
+			if algo == "" {
+				continue
+			}
+			if err := add(algo, d[i+1:], name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return digests, nil
+}
+
+// Check the digests of the contents of an upload, set in its metadata,
+// against the expected ones.
+func checkDigests(metadata *DocMetadata, expected map[string]string) error {
+	for algo, digest := range expected {
+		if actual := *hashAlgos[algo].field(metadata); actual != digest {
+			return fmt.Errorf("%s digest of the upload is %s, not %s", instanceDigestNames[algo], actual, digest)
+		}
+	}
+	return nil
+}
+
+// Copy a request body to a temporary file and check it against the expected
+// digests before any of it is used. A mismatch gives a bodyDigestError.
+// Returns the file positioned at its start, to be closed and removed by the
+// caller.
+func spoolBody(body io.Reader, expected map[string]string) (*os.File, error) {
+	f, err := ioutil.TempFile(dataDir, uploadPrefix)
+	if err != nil {
+		return nil, err
+	}
+	h := newContentHashes()
+	_, err = io.Copy(io.MultiWriter(f, h.writer()), body)
+	if err == nil {
+		metadata := &DocMetadata{}
+		h.setDigests(metadata)
+		if err = checkDigests(metadata, expected); err != nil {
+			err = bodyDigestError{err}
+		}
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// Get the digest algorithms requested by a Want-Digest header, as names in
+// hashAlgos in order of preference. Algorithms with a zero quality value or
+// that are not computed for uploads are left out.
+func wantedDigests(header string) []string {
+	type wanted struct {
+		algo string
+		q    float64
+	}
+	var want []wanted
+	for _, w := range strings.Split(header, ",") {
+		parts := strings.Split(w, ";")
+		algo := instanceDigestAlgo(strings.TrimSpace(parts[0]))
+		if algo == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, _ = strconv.ParseFloat(p[2:], 64)
+			}
+		}
+		if q > 0 {
+			want = append(want, wanted{algo, q})
+		}
+	}
+	sort.SliceStable(want, func(i, j int) bool { return want[i].q > want[j].q })
+	algos := make([]string, len(want))
+	for i, w := range want {
+		algos[i] = w.algo
+	}
+	return algos
+}
+
+// Set the Digest header of a response with the digests of a document for
+// the algorithms requested by a Want-Digest header, or SHA-256 without one.
+// Nothing is set for documents stored before digests were computed.
+func setDigestHeader(h http.Header, wantDigest string, metadata *DocMetadata) {
+	algos := []string{"sha256"}
+	if wantDigest != "" {
+		algos = wantedDigests(wantDigest)
+	}
+	var digests []string
+	for _, algo := range algos {
+		b, err := hex.DecodeString(*hashAlgos[algo].field(metadata))
+		if err != nil || len(b) == 0 {
+			continue
+		}
+		digests = append(digests, instanceDigestNames[algo]+"="+base64.StdEncoding.EncodeToString(b))
+	}
+	if len(digests) > 0 {
+		h.Set("Digest", strings.Join(digests, ","))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const testIntegrityKey = "integrity-123"
+
+func TestUploadDigest(t *testing.T) {
+	md5Sum := md5.Sum([]byte(testContent))
+	sha256Sum := sha256.Sum256([]byte(testContent))
+	contentMD5 := base64.StdEncoding.EncodeToString(md5Sum[:])
+
+	gofight.New().POST("/document/"+testIntegrityKey).
+		SetHeader(gofight.H{
+			"Content-MD5": contentMD5,
+			"Digest":      "UNIXsum=30637, SHA-256=" + base64.StdEncoding.EncodeToString(sha256Sum[:]),
+			"Want-Digest": "MD5",
+		}).
+		SetBody(testContent).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "MD5="+contentMD5, r.HeaderMap.Get("Digest"))
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.Equal(t, hex.EncodeToString(md5Sum[:]), resp.MD5, "Server digest should be returned")
+				assert.Equal(t, hex.EncodeToString(sha256Sum[:]), resp.SHA256, "Server digest should be returned")
+			}
+		})
+	cleanupDoc(t, testIntegrityKey)
+
+	for _, header := range []gofight.H{
+		{"Content-MD5": base64.StdEncoding.EncodeToString(make([]byte, md5.Size))},
+		{"Digest": "SHA-256=" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))},
+		{"Content-MD5": "not base64"},
+	} {
+		gofight.New().POST("/document/"+testIntegrityKey).
+			SetHeader(header).
+			SetBody(testContent).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusBadRequest, r.Code)
+			})
+		gofight.New().GET("/document/"+testIntegrityKey+"/metadata").
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusNotFound, r.Code, "Rejected document should not be stored")
+			})
+	}
+	tmpFiles, err := filepath.Glob(dataDir + "/.upload-*")
+	if assert.NoError(t, err) {
+		assert.Empty(t, tmpFiles, "Rejected uploads should not leave files")
+	}
+}
+
+func TestDownloadDigest(t *testing.T) {
+	gofight.New().POST("/document/"+testIntegrityKey).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testIntegrityKey)
+	md5Sum := md5.Sum([]byte(testContent))
+	sha1Sum := sha1.Sum([]byte(testContent))
+	sha256Sum := sha256.Sum256([]byte(testContent))
+
+	gofight.New().GET("/document/"+testIntegrityKey+"/content").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "SHA-256="+base64.StdEncoding.EncodeToString(sha256Sum[:]), r.HeaderMap.Get("Digest"))
+		})
+	gofight.New().GET("/document/"+testIntegrityKey+"/content").
+		SetHeader(gofight.H{"Want-Digest": "SHA;q=0.5, md5, SHA-512, SHA-256;q=0"}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "MD5="+base64.StdEncoding.EncodeToString(md5Sum[:])+",SHA="+base64.StdEncoding.EncodeToString(sha1Sum[:]), r.HeaderMap.Get("Digest"))
+		})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// Maximum length of a document key in bytes.
+const maxKeyLength = 255
+
+// Characters allowed in document keys besides ASCII letters and digits: the
+// characters that may appear unescaped in a URL path segment.
+const keyPunctuation = "-._~!$&'()*+,;=:@"
+
+// Prefix of the file names in the data directory of keys that are not
+// valid. No valid key starts with a dot.
+const invalidKeyPrefix = ".key-"
+
+// Key reserved for the routes finding documents by hash under /document.
+const byHashKey = "by-hash"
+
+// Error returned for a key that does not follow the key policy.
+var errInvalidKey = errors.New("invalid key")
+
+// Check that a document key follows the key policy: 1 to maxKeyLength ASCII
+// letters, digits or characters of keyPunctuation, not starting with a dot,
+// and not the name of the database file or byHashKey.
+func validateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%s: empty", errInvalidKey)
+	}
+	if len(key) > maxKeyLength {
+		return fmt.Errorf("%s: longer than %d bytes", errInvalidKey, maxKeyLength)
+	}
+	for _, r := range key {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && !strings.ContainsRune(keyPunctuation, r) {
+			return fmt.Errorf("%s %q: character %q is not allowed", errInvalidKey, key, r)
+		}
+	}
+	if key[0] == '.' {
+		return fmt.Errorf("%s %q: must not start with a dot", errInvalidKey, key)
+	}
+	if key == dbFileName || key == byHashKey {
+		return fmt.Errorf("%s %q: reserved name", errInvalidKey, key)
+	}
+	return nil
+}
+
+// Get the name in the data directory of the file, or the directory of
+// earlier versions, of a document key. A valid key is its own name. Any
+// other key, which the API never accepts, is hex encoded after a prefix that
+// no valid key has, so no key can name a path outside its directory, the
+// database file or a directory of the service.
+func keyFileName(key string) string {
+	if validateKey(key) == nil {
+		return key
+	}
+	return invalidKeyPrefix + hex.EncodeToString([]byte(key))
+}
+
+// Middleware rejecting requests for a route with an id parameter that is not
+// a valid key.
+func checkKeyParam(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		for _, name := range c.ParamNames() {
+			if name != "id" {
+				continue
+			}
+			key := c.Param(name)
+			if err := validateKey(key); err != nil {
+				return c.JSON(statusBadRequest, newErrorResp(key, "invalid key", err))
+			}
+		}
+		return next(c)
+	}
+}
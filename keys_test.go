@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateKey(t *testing.T) {
+	for _, key := range []string{"12345", "report-2017.pdf", "a~b_c@d:e", strings.Repeat("k", maxKeyLength)} {
+		assert.NoError(t, validateKey(key), key)
+		assert.Equal(t, key, path.Base(legacyPath(key)), key)
+	}
+	for _, key := range []string{"", dbFileName, byHashKey, ".", "..", ".versions", "../doc.db", "a/b", "%2e%2e", "a b", "café", strings.Repeat("k", maxKeyLength+1)} {
+		assert.Error(t, validateKey(key), key)
+		p := legacyPath(key)
+		assert.True(t, strings.HasPrefix(p, path.Join(dataDir, keyDocsDir)+"/"), key)
+		assert.True(t, strings.HasPrefix(path.Base(p), invalidKeyPrefix), key)
+	}
+}
+
+func TestInvalidKeyRoutes(t *testing.T) {
+	for _, key := range []string{dbFileName, ".versions", "%2e%2e", "a%2Fb", strings.Repeat("k", maxKeyLength+1)} {
+		for _, req := range []*gofight.RequestConfig{
+			gofight.New().GET("/document/" + key),
+			gofight.New().GET("/document/" + key + "/content"),
+			gofight.New().GET("/document/" + key + "/metadata"),
+			gofight.New().PATCH("/document/" + key + "/metadata").SetBody(`{"title": "t"}`),
+			gofight.New().GET("/document/" + key + "/versions"),
+			gofight.New().POST("/document/" + key + "/versions/1/restore"),
+			gofight.New().POST("/document/" + key).SetBody(testContent),
+			gofight.New().PUT("/document/" + key).SetBody(testContent),
+			gofight.New().DELETE("/document/" + key),
+		} {
+			req.Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusBadRequest, r.Code, rq.Method+" "+rq.URL.String())
+				assert.Contains(t, r.Body.String(), "invalid key", rq.URL.String())
+			})
+		}
+	}
+
+	gofight.New().POST("/documents/_mdelete").
+		SetBody(`{"ids": ["doc.db"]}`).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), "invalid key")
+		})
+	gofight.New().POST("/documents/_bulk").
+		SetHeader(gofight.H{"Content-Type": "application/x-ndjson"}).
+		SetBody(`{"key": "../escape", "document": "x"}`+"\n").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), "invalid key")
+		})
+
+	// The key of the hash lookup route cannot be created, so its routes
+	// never hide a document.
+	for _, req := range []*gofight.RequestConfig{
+		gofight.New().POST("/document/" + byHashKey).SetBody(testContent),
+		gofight.New().PUT("/document/" + byHashKey).SetBody(testContent),
+	} {
+		req.Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code, rq.Method+" "+rq.URL.String())
+			assert.Contains(t, r.Body.String(), "invalid key")
+		})
+	}
+	gofight.New().POST("/documents/_bulk").
+		SetHeader(gofight.H{"Content-Type": "application/x-ndjson"}).
+		SetBody(`{"key": "by-hash", "document": "x"}`+"\n").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Contains(t, r.Body.String(), "invalid key")
+		})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Directories in the data directory for the files of documents and earlier
+// versions stored under their key, before contents were deduplicated. They
+// used to be kept directly in the data directory and in versionsDir.
+const (
+	keyDocsDir     = ".docs"
+	keyVersionsDir = ".doc-versions"
+)
+
+// Get the two levels of fan-out directories for a file named after a hex
+// hash, from its first four digits, so no directory holds more than a few
+// thousand files even with millions of documents.
+func shardDirs(hash string) string {
+	if len(hash) < 4 {
+		return ""
+	}
+	return path.Join(hash[:2], hash[2:4])
+}
+
+// Get the fan-out directories for a file named after a key, from the hash of
+// its name.
+func nameShardDirs(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return shardDirs(hex.EncodeToString(sum[:]))
+}
+
+// Get the first of the paths to a file that exists, or the first path if
+// none does. Files are looked up in the sharded layout first, then in the
+// flat layout they are migrated from.
+func locate(paths ...string) string {
+	for _, p := range paths {
+		if _, err := os.Lstat(p); err == nil {
+			return p
+		}
+	}
+	return paths[0]
+}
+
+// Apply an operation to a file at a path found by locate. If the file was
+// moved by a concurrent migration in between, it is found again and the
+// operation retried; a file is only ever moved once.
+func retryMoved(find func() string, fn func(string) error) error {
+	err := fn(find())
+	if os.IsNotExist(err) {
+		err = fn(find())
+	}
+	return err
+}
+
+// Open a file at a path found by locate, following a concurrent migration.
+func openMoved(find func() string) (*os.File, error) {
+	var f *os.File
+	err := retryMoved(find, func(p string) error {
+		var err error
+		f, err = os.Open(p)
+		return err
+	})
+	return f, err
+}
+
+// Get the path of a file of a document stored under its key, in the sharded
+// layout.
+func shardedLegacyPath(name string) string {
+	return path.Join(dataDir, keyDocsDir, nameShardDirs(name), name)
+}
+
+// Get the directory of the files of the earlier versions of a document
+// stored under its key, in the sharded layout.
+func shardedVersionDir(name string) string {
+	return path.Join(dataDir, keyVersionsDir, nameShardDirs(name), name)
+}
+
+// Move a file into a new directory, creating it. A file that is already gone
+// is skipped.
+func moveFile(from, to string) (bool, error) {
+	if err := os.MkdirAll(path.Dir(to), 0777); err != nil {
+		return false, err
+	}
+	err := os.Rename(from, to)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Move the files in the flat layout into the sharded one: blobs into
+// fan-out directories in blobsDir, and files of documents and earlier
+// versions stored under their key into keyDocsDir and keyVersionsDir. Only
+// files are moved, without the database, so the migration can run while the
+// service is up; lookups find files in either layout. Returns the number of
+// files moved.
+func migrateLayout() (int, error) {
+	n := 0
+	blobs, err := ioutil.ReadDir(path.Join(dataDir, blobsDir))
+	if err != nil && !os.IsNotExist(err) {
+		return n, err
+	}
+	for _, fi := range blobs {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		digest := fi.Name()
+		from := path.Join(dataDir, blobsDir, digest)
+		to := shardedBlobPath(digest)
+		if _, err = os.Stat(to); err == nil {
+			// Blobs with the same digest have the same contents.
+			if err = os.Remove(from); err != nil && !os.IsNotExist(err) {
+				return n, err
+			}
+			continue
+		}
+		moved, err := moveFile(from, to)
+		if err != nil {
+			return n, err
+		}
+		if moved {
+			n++
+		}
+	}
+
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return n, err
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || validateKey(name) != nil && !strings.HasPrefix(name, invalidKeyPrefix) {
+			continue
+		}
+		to := shardedLegacyPath(name)
+		if _, err = os.Stat(to); err == nil {
+			// Left for fsck to sort out.
+			continue
+		}
+		moved, err := moveFile(path.Join(dataDir, name), to)
+		if err != nil {
+			return n, err
+		}
+		if moved {
+			n++
+		}
+	}
+
+	dirs, err := ioutil.ReadDir(path.Join(dataDir, versionsDir))
+	if err != nil && !os.IsNotExist(err) {
+		return n, err
+	}
+	for _, dir := range dirs {
+		dirPath := path.Join(dataDir, versionsDir, dir.Name())
+		versions, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			return n, err
+		}
+		for _, fi := range versions {
+			if _, err = strconv.Atoi(fi.Name()); err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			moved, err := moveFile(path.Join(dirPath, fi.Name()), path.Join(shardedVersionDir(dir.Name()), fi.Name()))
+			if err != nil {
+				return n, err
+			}
+			if moved {
+				n++
+			}
+		}
+		// Only removed once empty.
+		os.Remove(dirPath)
+	}
+	os.Remove(path.Join(dataDir, versionsDir))
+	return n, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testLayoutKey       = "layout-123"
+	testLayoutLegacyKey = "layout-legacy"
+)
+
+// Get the contents of a version of a document.
+func testVersionContents(t *testing.T, key string, version int) string {
+	var doc string
+	gofight.New().GET("/document/"+key+"/versions/"+strconv.Itoa(version)).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			doc = r.Body.String()
+		})
+	return doc
+}
+
+func TestMigrateLayout(t *testing.T) {
+	// A document in the flat blob store.
+	gofight.New().POST("/document/"+testLayoutKey).
+		SetBody("layout contents").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testLayoutKey)
+	digest := testBlobDigest("layout contents")
+	flatBlob := path.Join(dataDir, blobsDir, digest)
+	assert.NoError(t, os.Rename(shardedBlobPath(digest), flatBlob))
+
+	// A document and an earlier version stored under their key, in the
+	// data directory and versionsDir.
+	flatDoc := path.Join(dataDir, testLayoutLegacyKey)
+	flatVersion := path.Join(dataDir, versionsDir, testLayoutLegacyKey, "1")
+	assert.NoError(t, os.MkdirAll(path.Dir(flatVersion), 0777))
+	assert.NoError(t, ioutil.WriteFile(flatDoc, []byte("legacy 2"), 0666))
+	assert.NoError(t, ioutil.WriteFile(flatVersion, []byte("legacy 1"), 0666))
+	err := updateBlobs(func(tx metaTx) error {
+		if err := putMetadata(tx, testLayoutLegacyKey, &DocMetadata{Timestamp: 1, ContentType: "text/plain", Version: 2}); err != nil {
+			return err
+		}
+		b, err := tx.bucket(versionsBucket).createBucketIfNotExists([]byte(testLayoutLegacyKey))
+		if err != nil {
+			return err
+		}
+		buf, err := encodeMetadata(&DocMetadata{Timestamp: 1, ContentType: "text/plain", Version: 1})
+		if err != nil {
+			return err
+		}
+		return b.put(versionKey(1), buf)
+	})
+	assert.NoError(t, err)
+	defer cleanupDoc(t, testLayoutLegacyKey)
+
+	check := func() {
+		gofight.New().GET("/document/"+testLayoutKey+"/content").
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+				assert.Equal(t, "layout contents", r.Body.String())
+			})
+		gofight.New().GET("/document/"+testLayoutLegacyKey+"/content").
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+				assert.Equal(t, "legacy 2", r.Body.String())
+			})
+		assert.Contains(t, testVersionContents(t, testLayoutLegacyKey, 1), "legacy 1")
+	}
+	check()
+
+	n, err := migrateLayout()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, n)
+	}
+	for _, p := range []string{flatBlob, flatDoc, flatVersion, path.Join(dataDir, versionsDir)} {
+		_, err = os.Stat(p)
+		assert.True(t, os.IsNotExist(err), p+" should be moved")
+	}
+	assert.Equal(t, shardedBlobPath(digest), blobPath(digest))
+	assert.Equal(t, shardedLegacyPath(testLayoutLegacyKey), legacyPath(testLayoutLegacyKey))
+	check()
+
+	f := &fsck{}
+	if assert.NoError(t, f.run()) {
+		assert.Empty(t, f.problems, "Migrated files should belong to their records")
+	}
+	n, err = migrateLayout()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, n, "Nothing should be left to migrate")
+	}
+}
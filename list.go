@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// Default number of documents returned in a listing page.
+	defaultListLimit = 100
+	// Maximum number of documents returned in a listing page.
+	maxListLimit = 1000
+)
+
+// DocumentEntry struct for a document key and its metadata in a listing.
+type DocumentEntry struct {
+	Key string `json:"key"`
+	DocMetadata
+}
+
+// Filters on a document listing. Empty values match every document.
+type listQuery struct {
+	extractor   string
+	contentType string
+	// Range of ingest timestamps, in Unix seconds; zero is unbounded.
+	since int64
+	until int64
+}
+
+// Check if the metadata of a document matches the listing filters.
+func (q *listQuery) matches(metadata *DocMetadata) bool {
+	if q.extractor != "" && metadata.Extractor != q.extractor {
+		return false
+	}
+	if q.contentType != "" && indexContentType(metadata.ContentType) != q.contentType {
+		return false
+	}
+	if q.since > 0 && metadata.Timestamp < q.since {
+		return false
+	}
+	if q.until > 0 && metadata.Timestamp > q.until {
+		return false
+	}
+	return true
+}
+
+// List documents, a page at a time. The "limit" query parameter sets the
+// page size, and "after" takes the continuation token returned with the
+// previous page. The "extractor", "content-type", "since" and "until" query
+// parameters filter the documents using the secondary indexes. Documents are
+// listed in key order, except when filtering only by time, when they are
+// listed in time order. Each page is read in its own transaction, so
+// documents can be written while the listing is in progress.
+func listDocs(c echo.Context) error {
+	limit, err := listLimit(c.QueryParam("limit"))
+	if err != nil {
+		return c.JSON(statusBadRequest, newErrorResp("", "invalid limit", err))
+	}
+	after, err := decodeListToken(c.QueryParam("after"))
+	if err != nil {
+		return c.JSON(statusBadRequest, newErrorResp("", "invalid continuation token", err))
+	}
+	q := &listQuery{
+		extractor:   c.QueryParam("extractor"),
+		contentType: indexContentType(c.QueryParam("content-type")),
+	}
+	if q.since, err = listTime(c.QueryParam("since")); err != nil {
+		return c.JSON(statusBadRequest, newErrorResp("", "invalid since time", err))
+	}
+	if q.until, err = listTime(c.QueryParam("until")); err != nil {
+		return c.JSON(statusBadRequest, newErrorResp("", "invalid until time", err))
+	}
+	entries, next, err := listMetadata(q, after, limit)
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp("", "error listing documents", err))
+	}
+	r := newSuccessResp("", "")
+	r.Documents = entries
+	r.Next = next
+	return c.JSON(statusOk, r)
+}
+
+// Read a page of up to limit documents matching a query, after the position
+// of a previous page. Returns the continuation token for the next page,
+// which is empty on the last page.
+func listMetadata(q *listQuery, after []byte, limit int) ([]*DocumentEntry, string, error) {
+	entries := []*DocumentEntry{}
+	next := ""
+	err := db.view(func(tx metaTx) error {
+		b := tx.bucket(dbBucket)
+		ic, start := listCursor(tx, q)
+		if after != nil {
+			start = after
+		}
+		k, key := ic.seek(start)
+		if after != nil && bytes.Equal(k, after) {
+			k, key = ic.next()
+		}
+		var last []byte
+		for ; k != nil; k, key = ic.next() {
+			if len(entries) == limit {
+				next = encodeListToken(last)
+				break
+			}
+			if ic.timestamps && q.until > 0 && int64(binary.BigEndian.Uint64(k)) > q.until {
+				// Past the end of the time range.
+				break
+			}
+			v := b.get(key)
+			if v == nil {
+				// Stale index entry.
+				continue
+			}
+			metadata, err := decodeMetadata(v)
+			if err != nil {
+				return fmt.Errorf("error reading metadata for key %s: %s", key, err)
+			}
+			if !q.matches(metadata) {
+				continue
+			}
+			entries = append(entries, &DocumentEntry{Key: string(key), DocMetadata: *metadata})
+			last = append([]byte{}, k...)
+		}
+		return nil
+	})
+	return entries, next, err
+}
+
+// Get the cursor that drives a listing and the position to start it from.
+// An equality filter uses its index, a time range uses the timestamp index,
+// and an unfiltered listing walks the metadata bucket.
+func listCursor(tx metaTx, q *listQuery) (*indexCursor, []byte) {
+	switch {
+	case q.extractor != "":
+		prefix := stringIndexPrefix(q.extractor)
+		return &indexCursor{c: tx.bucket(extractorIndexBucket).cursor(), prefix: prefix, valueLen: len(prefix)}, prefix
+	case q.contentType != "":
+		prefix := stringIndexPrefix(q.contentType)
+		return &indexCursor{c: tx.bucket(contentTypeIndexBucket).cursor(), prefix: prefix, valueLen: len(prefix)}, prefix
+	case q.since > 0 || q.until > 0:
+		return &indexCursor{c: tx.bucket(timestampIndexBucket).cursor(), valueLen: 8, timestamps: true}, timestampIndexPrefix(q.since)
+	}
+	return &indexCursor{c: tx.bucket(dbBucket).cursor()}, nil
+}
+
+// Parse a time filter of a listing, in Unix seconds.
+func listTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || t <= 0 {
+		return 0, fmt.Errorf("time must be a positive number of seconds since the epoch")
+	}
+	return t, nil
+}
+
+// Parse the page size of a listing.
+func listLimit(s string) (int, error) {
+	if s == "" {
+		return defaultListLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit <= 0 || limit > maxListLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+	}
+	return limit, nil
+}
+
+// Encode the position of the last entry of a listing page as an opaque
+// continuation token.
+func encodeListToken(k []byte) string {
+	return base64.RawURLEncoding.EncodeToString(k)
+}
+
+// Decode a continuation token into the position of the last entry of the
+// previous page, or nil for the first page.
+func decodeListToken(token string) ([]byte, error) {
+	if token == "" {
+		return nil, nil
+	}
+	return base64.RawURLEncoding.DecodeString(token)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListDocs(t *testing.T) {
+	keys := []string{"list-1", "list-2", "list-3"}
+	for _, key := range keys {
+		gofight.New().POST("/document/"+key).
+			SetQuery(gofight.H{
+				"extractor": testExtractor,
+			}).
+			SetBody(testJSON).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+		defer cleanupDoc(t, key)
+	}
+
+	// Page through everything two at a time.
+	var listed []string
+	after := ""
+	for pages := 0; pages < 100; pages++ {
+		var resp ResponseType
+		gofight.New().GET("/documents").
+			SetQuery(gofight.H{
+				"limit": "2",
+				"after": after,
+			}).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+				err := json.Unmarshal([]byte(r.Body.String()), &resp)
+				assert.NoError(t, err)
+			})
+		assert.True(t, len(resp.Documents) <= 2, "Page should not exceed the limit")
+		for _, entry := range resp.Documents {
+			if strings.HasPrefix(entry.Key, "list-") {
+				listed = append(listed, entry.Key)
+				assert.Equal(t, testExtractor, entry.Extractor, "Extractor metadata should match")
+			}
+		}
+		if resp.Next == "" {
+			break
+		}
+		after = resp.Next
+	}
+	assert.Equal(t, keys, listed)
+
+	gofight.New().GET("/documents").
+		SetQuery(gofight.H{
+			"limit": "0",
+		}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		})
+}
+
+// List the keys of all documents matching the query parameters.
+func listKeys(t *testing.T, query gofight.H) []string {
+	keys := []string{}
+	gofight.New().GET("/documents").
+		SetQuery(query).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				for _, entry := range resp.Documents {
+					keys = append(keys, entry.Key)
+				}
+			}
+		})
+	return keys
+}
+
+func TestListDocsFiltered(t *testing.T) {
+	docs := []struct {
+		key, extractor, contentType string
+	}{
+		{"filter-1", "extractor-a", "application/pdf"},
+		{"filter-2", "extractor-b", "application/pdf; name=x.pdf"},
+		{"filter-3", "extractor-a", "text/plain"},
+	}
+	for _, doc := range docs {
+		gofight.New().POST("/document/"+doc.key).
+			SetQuery(gofight.H{
+				"extractor": doc.extractor,
+			}).
+			SetHeader(gofight.H{
+				"Content-Type": doc.contentType,
+			}).
+			SetBody(testContent).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+	}
+
+	assert.Equal(t, []string{"filter-1", "filter-3"}, listKeys(t, gofight.H{"extractor": "extractor-a"}))
+	assert.Equal(t, []string{"filter-1", "filter-2"}, listKeys(t, gofight.H{"content-type": "application/pdf"}))
+	assert.Equal(t, []string{"filter-1"}, listKeys(t, gofight.H{"extractor": "extractor-a", "content-type": "application/pdf"}))
+	since := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	assert.Len(t, listKeys(t, gofight.H{"extractor": "extractor-a", "since": since}), 2)
+	assert.Empty(t, listKeys(t, gofight.H{"extractor": "extractor-a", "until": "1"}))
+
+	// Paging through an index.
+	first := []string{}
+	var next string
+	gofight.New().GET("/documents").
+		SetQuery(gofight.H{"extractor": "extractor-a", "limit": "1"}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			var resp ResponseType
+			if assert.NoError(t, json.Unmarshal([]byte(r.Body.String()), &resp)) {
+				for _, entry := range resp.Documents {
+					first = append(first, entry.Key)
+				}
+				next = resp.Next
+			}
+		})
+	assert.Equal(t, []string{"filter-1"}, first)
+	assert.Equal(t, []string{"filter-3"}, listKeys(t, gofight.H{"extractor": "extractor-a", "after": next}))
+
+	// The indexes follow metadata updates and deletes.
+	gofight.New().PATCH("/document/filter-3/metadata").
+		SetBody(`{"extractor": "extractor-b"}`).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	assert.Equal(t, []string{"filter-1"}, listKeys(t, gofight.H{"extractor": "extractor-a"}))
+	for _, doc := range docs {
+		cleanupDoc(t, doc.key)
+	}
+	assert.Empty(t, listKeys(t, gofight.H{"extractor": "extractor-b"}))
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	errKeyRequired       = errors.New("key required")
+	errIncompatibleValue = errors.New("incompatible value")
+)
+
+// Metadata store kept in memory, for tests and ephemeral deployments.
+// Read-only transactions share a lock, and a read-write transaction holds
+// it alone, undoing its changes if it fails.
+type memoryMetaStore struct {
+	mu   sync.RWMutex
+	root *memBucket
+}
+
+// Bucket of a memory metadata store, with its keys kept sorted. A key has
+// either a value or a nested bucket.
+type memBucket struct {
+	keys    []string
+	values  map[string][]byte
+	buckets map[string]*memBucket
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{values: map[string][]byte{}, buckets: map[string]*memBucket{}}
+}
+
+// Create a memory metadata store with the top-level buckets.
+func newMemoryMetaStore(buckets ...[]byte) *memoryMetaStore {
+	s := &memoryMetaStore{root: newMemBucket()}
+	for _, name := range buckets {
+		s.root.insert(string(name), nil, newMemBucket())
+	}
+	return s
+}
+
+func (s *memoryMetaStore) view(fn func(metaTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(&memTx{root: s.root})
+}
+
+func (s *memoryMetaStore) update(fn func(metaTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := &memTx{root: s.root, writable: true}
+	err := fn(tx)
+	if err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+	}
+	return err
+}
+
+func (s *memoryMetaStore) close() error {
+	return nil
+}
+
+// Position of a key in a bucket, and whether it is there.
+func (b *memBucket) search(key string) (int, bool) {
+	i := sort.SearchStrings(b.keys, key)
+	return i, i < len(b.keys) && b.keys[i] == key
+}
+
+// Set a key to a value or a nested bucket.
+func (b *memBucket) insert(key string, value []byte, bucket *memBucket) {
+	if i, ok := b.search(key); !ok {
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+	}
+	if bucket != nil {
+		delete(b.values, key)
+		b.buckets[key] = bucket
+	} else {
+		delete(b.buckets, key)
+		b.values[key] = value
+	}
+}
+
+func (b *memBucket) remove(key string) {
+	if i, ok := b.search(key); ok {
+		b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	}
+	delete(b.values, key)
+	delete(b.buckets, key)
+}
+
+// Key and value at a position, or a nil key past the end.
+func (b *memBucket) at(i int) ([]byte, []byte) {
+	if i >= len(b.keys) {
+		return nil, nil
+	}
+	return []byte(b.keys[i]), b.values[b.keys[i]]
+}
+
+// Transaction on a memory metadata store, with the functions undoing each
+// change it made.
+type memTx struct {
+	root     *memBucket
+	writable bool
+	undo     []func()
+}
+
+// Set a key of a bucket, recording how to restore what it had.
+func (t *memTx) set(b *memBucket, key string, value []byte, bucket *memBucket) {
+	oldValue, hadValue := b.values[key]
+	oldBucket, hadBucket := b.buckets[key]
+	t.undo = append(t.undo, func() {
+		switch {
+		case hadValue:
+			b.insert(key, oldValue, nil)
+		case hadBucket:
+			b.insert(key, nil, oldBucket)
+		default:
+			b.remove(key)
+		}
+	})
+	if value == nil && bucket == nil {
+		b.remove(key)
+	} else {
+		b.insert(key, value, bucket)
+	}
+}
+
+func (t *memTx) wrap(b *memBucket) metaBucket {
+	if b == nil {
+		return nil
+	}
+	return memBucketTx{b, t}
+}
+
+func (t *memTx) bucket(name []byte) metaBucket {
+	return t.wrap(t.root.buckets[string(name)])
+}
+
+func (t *memTx) createBucket(name []byte) (metaBucket, error) {
+	return memBucketTx{t.root, t}.create(name, false)
+}
+
+func (t *memTx) deleteBucket(name []byte) error {
+	return memBucketTx{t.root, t}.deleteBucket(name)
+}
+
+// Bucket of a memory metadata store in a transaction.
+type memBucketTx struct {
+	b  *memBucket
+	tx *memTx
+}
+
+func (b memBucketTx) get(key []byte) []byte {
+	return b.b.values[string(key)]
+}
+
+func (b memBucketTx) put(key, value []byte) error {
+	switch {
+	case !b.tx.writable:
+		return errTxNotWritable
+	case len(key) == 0:
+		return errKeyRequired
+	case b.b.buckets[string(key)] != nil:
+		return errIncompatibleValue
+	}
+	b.tx.set(b.b, string(key), append([]byte{}, value...), nil)
+	return nil
+}
+
+func (b memBucketTx) delete(key []byte) error {
+	switch {
+	case !b.tx.writable:
+		return errTxNotWritable
+	case b.b.buckets[string(key)] != nil:
+		return errIncompatibleValue
+	}
+	if _, ok := b.b.values[string(key)]; ok {
+		b.tx.set(b.b, string(key), nil, nil)
+	}
+	return nil
+}
+
+func (b memBucketTx) forEach(fn func(k, v []byte) error) error {
+	for _, k := range append([]string{}, b.b.keys...) {
+		if err := fn([]byte(k), b.b.values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b memBucketTx) cursor() metaCursor {
+	return &memCursor{b: b.b}
+}
+
+func (b memBucketTx) bucket(name []byte) metaBucket {
+	return b.tx.wrap(b.b.buckets[string(name)])
+}
+
+func (b memBucketTx) createBucketIfNotExists(name []byte) (metaBucket, error) {
+	return b.create(name, true)
+}
+
+func (b memBucketTx) create(name []byte, mayExist bool) (metaBucket, error) {
+	if nested := b.b.buckets[string(name)]; nested != nil {
+		if mayExist {
+			return b.tx.wrap(nested), nil
+		}
+		return nil, errBucketExists
+	}
+	switch {
+	case !b.tx.writable:
+		return nil, errTxNotWritable
+	case len(name) == 0:
+		return nil, errKeyRequired
+	case b.b.values[string(name)] != nil:
+		return nil, errIncompatibleValue
+	}
+	nested := newMemBucket()
+	b.tx.set(b.b, string(name), nil, nested)
+	return b.tx.wrap(nested), nil
+}
+
+func (b memBucketTx) deleteBucket(name []byte) error {
+	switch {
+	case !b.tx.writable:
+		return errTxNotWritable
+	case b.b.buckets[string(name)] == nil:
+		return errBucketNotFound
+	}
+	b.tx.set(b.b, string(name), nil, nil)
+	return nil
+}
+
+// Cursor on a bucket of a memory metadata store. It keeps the key it is at
+// rather than a position, so it stays in order when keys change.
+type memCursor struct {
+	b   *memBucket
+	key []byte
+}
+
+func (c *memCursor) move(i int) ([]byte, []byte) {
+	k, v := c.b.at(i)
+	c.key = k
+	return k, v
+}
+
+func (c *memCursor) first() ([]byte, []byte) {
+	return c.move(0)
+}
+
+func (c *memCursor) seek(seek []byte) ([]byte, []byte) {
+	i, _ := c.b.search(string(seek))
+	return c.move(i)
+}
+
+func (c *memCursor) next() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+	i, ok := c.b.search(string(c.key))
+	if ok {
+		i++
+	}
+	return c.move(i)
+}
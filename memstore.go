@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Blob store keeping blobs in memory, for tests and ephemeral deployments.
+// Blobs are lost when the service stops.
+type memoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+	// Blobs moved out of the way by quarantine.
+	quarantined map[string][]byte
+}
+
+func newMemoryBlobStore() *memoryBlobStore {
+	return &memoryBlobStore{blobs: map[string][]byte{}, quarantined: map[string][]byte{}}
+}
+
+// Read the file into memory. The file is left for the caller to remove.
+func (s *memoryBlobStore) put(digest, filePath string) error {
+	s.mu.RLock()
+	_, ok := s.blobs[digest]
+	s.mu.RUnlock()
+	if ok {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.blobs[digest] = b
+	s.mu.Unlock()
+	return nil
+}
+
+// Contents of a blob in memory being read.
+type memoryBlobReader struct {
+	*bytes.Reader
+}
+
+func (memoryBlobReader) Close() error {
+	return nil
+}
+
+func (s *memoryBlobStore) open(digest string) (blobReader, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.blobs[digest]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	// Blobs are never modified, so readers can share them.
+	return memoryBlobReader{bytes.NewReader(b)}, nil
+}
+
+func (s *memoryBlobStore) size(digest string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.blobs[digest]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(len(b)), nil
+}
+
+func (s *memoryBlobStore) remove(digest string) error {
+	s.mu.Lock()
+	delete(s.blobs, digest)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryBlobStore) list(fn func(digest string) error) error {
+	s.mu.RLock()
+	digests := make([]string, 0, len(s.blobs))
+	for digest := range s.blobs {
+		digests = append(digests, digest)
+	}
+	s.mu.RUnlock()
+	sort.Strings(digests)
+	for _, digest := range digests {
+		if err := fn(digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryBlobStore) quarantine(digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[digest]
+	if !ok {
+		return os.ErrNotExist
+	}
+	s.quarantined[digest] = b
+	delete(s.blobs, digest)
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Prefix of request headers holding user-defined metadata fields.
+const metaHeaderPrefix = "X-Doc-Meta-"
+
+// Form values that are not user-defined metadata fields, either because
+// they set a fixed metadata field or because they control the request.
+var reservedFormValues = map[string]bool{
+	"name":             true,
+	"extractor":        true,
+	"dc:title":         true,
+	"dcterms:created":  true,
+	"dcterms:modified": true,
+	"dedupe":           true,
+}
+
+// Error for a metadata patch that is not a valid JSON merge patch.
+type patchError struct {
+	msg string
+}
+
+func (e *patchError) Error() string {
+	return e.msg
+}
+
+// Get the metadata of a document, without reading the document itself. An
+// unchanged document gets 304 Not Modified, following If-None-Match and
+// If-Modified-Since.
+func getDocMetadata(c echo.Context) error {
+	key := c.Param("id")
+	metadata, err := getMetadata(key)
+	if err == errKeyNotFound {
+		return c.JSON(statusNotFound, newErrorResp(key, "key not found", err))
+	}
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp(key, "error reading metadata", err))
+	}
+	setValidators(c.Response().Header(), metadata)
+	if notModified(c.Request(), metadata) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSON(statusOk, newMetadataResp(key, "", metadata))
+}
+
+// Update the metadata of a document with a JSON merge patch (RFC 7396).
+// Fields present in the patch are replaced, fields set to null are cleared,
+// and all other fields are kept. The document itself is not modified. With
+// If-Match, the metadata is only updated if the document ETag matches.
+func patchDocMetadata(c echo.Context) error {
+	key := c.Param("id")
+	body := c.Request().Body
+	defer body.Close()
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&patch); err != nil {
+		return c.JSON(statusBadRequest, newErrorResp(key, "invalid metadata patch", err))
+	}
+
+	match := c.Request().Header.Get("If-Match")
+	metadata, err := updateMetadata(key, func(metadata *DocMetadata) error {
+		if err := ifMatch(match, metadata); err != nil {
+			return err
+		}
+		if err := applyMetadataPatch(metadata, patch); err != nil {
+			return err
+		}
+		metadata.Updated = time.Now().Unix()
+		return nil
+	})
+	if err == errKeyNotFound {
+		return c.JSON(statusNotFound, newErrorResp(key, "key not found", err))
+	}
+	if err == errPreconditionFailed {
+		return c.JSON(statusPreconditionFailed, newErrorResp(key, "precondition failed", err))
+	}
+	if _, ok := err.(*patchError); ok {
+		return c.JSON(statusBadRequest, newErrorResp(key, "invalid metadata patch", err))
+	}
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp(key, "error updating metadata", err))
+	}
+	return docJSON(c, statusOk, newMetadataResp(key, "updated metadata", metadata))
+}
+
+// Build the metadata of an uploaded document from its form values and
+// request headers.
+func uploadMetadata(values url.Values, header http.Header) *DocMetadata {
+	return &DocMetadata{
+		Timestamp:        time.Now().Unix(),
+		Name:             values.Get("name"),
+		ContentType:      header.Get("Content-Type"),
+		Extractor:        values.Get("extractor"),
+		Title:            values.Get("dc:title"),
+		CreationDate:     values.Get("dcterms:created"),
+		ModificationDate: values.Get("dcterms:modified"),
+		Meta:             uploadMeta(values, header),
+	}
+}
+
+// Get the options for saving an upload from its form values and request
+// headers. With "dedupe=true", a document with the same contents as an
+// existing document is not saved, and the existing key is returned instead.
+func uploadOptions(values url.Values, header http.Header, overwrite bool) saveOptions {
+	dedupe, _ := strconv.ParseBool(values.Get("dedupe"))
+	return saveOptions{overwrite: overwrite, dedupe: dedupe, ifMatch: header.Get("If-Match")}
+}
+
+// Get the user-defined metadata fields of an upload, from form values other
+// than the reserved ones and from X-Doc-Meta-* headers (with the lower case
+// header name suffix as the field name). Headers take precedence.
+func uploadMeta(values url.Values, header http.Header) map[string]string {
+	meta := map[string]string{}
+	for name, v := range values {
+		if !reservedFormValues[name] && len(v) > 0 {
+			meta[name] = v[0]
+		}
+	}
+	for name, v := range header {
+		if strings.HasPrefix(name, metaHeaderPrefix) && len(name) > len(metaHeaderPrefix) && len(v) > 0 {
+			meta[strings.ToLower(name[len(metaHeaderPrefix):])] = v[0]
+		}
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+// Apply a JSON merge patch to the editable metadata fields.
+func applyMetadataPatch(metadata *DocMetadata, patch map[string]json.RawMessage) error {
+	fields := map[string]*string{
+		"name":              &metadata.Name,
+		"content-type":      &metadata.ContentType,
+		"extractor":         &metadata.Extractor,
+		"title":             &metadata.Title,
+		"creation-date":     &metadata.CreationDate,
+		"modification-date": &metadata.ModificationDate,
+	}
+	for name, value := range patch {
+		if name == "meta" {
+			if err := applyMetaPatch(metadata, value); err != nil {
+				return err
+			}
+			continue
+		}
+		field, ok := fields[name]
+		if !ok {
+			if name == "timestamp" || name == "updated" {
+				return &patchError{fmt.Sprintf("metadata field %s is read-only", name)}
+			}
+			return &patchError{fmt.Sprintf("unknown metadata field %s", name)}
+		}
+		if string(value) == "null" {
+			*field = ""
+			continue
+		}
+		if err := json.Unmarshal(value, field); err != nil {
+			return &patchError{fmt.Sprintf("metadata field %s must be a string", name)}
+		}
+	}
+	return nil
+}
+
+// Apply the "meta" member of a JSON merge patch to the user-defined metadata
+// fields. A null value clears the field, or all fields if the whole member
+// is null.
+func applyMetaPatch(metadata *DocMetadata, value json.RawMessage) error {
+	if string(value) == "null" {
+		metadata.Meta = nil
+		return nil
+	}
+	var patch map[string]*string
+	if err := json.Unmarshal(value, &patch); err != nil {
+		return &patchError{"metadata field meta must be an object of strings"}
+	}
+	if metadata.Meta == nil {
+		metadata.Meta = map[string]string{}
+	}
+	for name, v := range patch {
+		if v == nil {
+			delete(metadata.Meta, name)
+		} else {
+			metadata.Meta[name] = *v
+		}
+	}
+	if len(metadata.Meta) == 0 {
+		metadata.Meta = nil
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const testMetadataKey = "metadata-123"
+
+func TestGetDocMetadata(t *testing.T) {
+	r := gofight.New()
+	r.POST("/document/"+testMetadataKey).
+		SetQuery(gofight.H{
+			"extractor": testExtractor,
+			"dc:title":  testTitle,
+		}).
+		SetBody(testJSON).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testMetadataKey)
+
+	r.GET("/document/"+testMetadataKey+"/metadata").
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.True(t, resp.Ok, "Response ok should be true")
+				assert.Empty(t, resp.Document, "Document should not be returned")
+				assert.Equal(t, testExtractor, resp.Extractor, "Extractor metadata should match")
+				assert.Equal(t, testTitle, resp.Title, "Title metadata should match")
+			}
+		})
+
+	r.GET("/document/missing-key/metadata").
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotFound, r.Code)
+		})
+}
+
+func TestPatchDocMetadata(t *testing.T) {
+	r := gofight.New()
+	r.POST("/document/"+testMetadataKey).
+		SetQuery(gofight.H{
+			"extractor": testExtractor,
+			"dc:title":  testTitle,
+			"name":      "old-name",
+		}).
+		SetBody(testJSON).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testMetadataKey)
+
+	r.PATCH("/document/"+testMetadataKey+"/metadata").
+		SetBody(`{"title": "new-title", "name": null}`).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.True(t, resp.Ok, "Response ok should be true")
+				assert.Equal(t, "new-title", resp.Title, "Title should be replaced")
+				assert.Empty(t, resp.Name, "Name should be cleared")
+				assert.Equal(t, testExtractor, resp.Extractor, "Extractor should be kept")
+				assert.NotZero(t, resp.Updated, "Update time should be set")
+			}
+		})
+
+	r.PATCH("/document/"+testMetadataKey+"/metadata").
+		SetBody(`{"timestamp": 1}`).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		})
+
+	r.PATCH("/document/missing-key/metadata").
+		SetBody(`{"title": "new-title"}`).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotFound, r.Code)
+		})
+}
+
+func TestUserMetadata(t *testing.T) {
+	r := gofight.New()
+	r.POST("/document/"+testMetadataKey).
+		SetQuery(gofight.H{
+			"extractor": testExtractor,
+			"source":    "feed-a",
+			"tlp":       "green",
+		}).
+		SetHeader(gofight.H{
+			"X-Doc-Meta-Language": "en",
+			"X-Doc-Meta-Tlp":      "amber",
+		}).
+		SetBody(testJSON).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testMetadataKey)
+
+	gofight.New().GET("/document/"+testMetadataKey).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.Equal(t, testExtractor, resp.Extractor, "Extractor metadata should match")
+				assert.Equal(t, map[string]string{
+					"source":   "feed-a",
+					"tlp":      "amber",
+					"language": "en",
+				}, resp.Meta)
+			}
+		})
+
+	gofight.New().PATCH("/document/"+testMetadataKey+"/metadata").
+		SetBody(`{"meta": {"tlp": "red", "source": null, "url": "http://example.com"}}`).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.Equal(t, map[string]string{
+					"tlp":      "red",
+					"language": "en",
+					"url":      "http://example.com",
+				}, resp.Meta)
+			}
+		})
+}
+
+func TestLegacyMetadataRecord(t *testing.T) {
+	// The metadata record as stored before user-defined fields were added.
+	type DocMetadata struct {
+		Timestamp        int64
+		Name             string
+		ContentType      string
+		Extractor        string
+		Title            string
+		CreationDate     string
+		ModificationDate string
+	}
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(&DocMetadata{Timestamp: 1416534798, Extractor: testExtractor})
+	if assert.NoError(t, err) {
+		metadata, err := decodeMetadata(buf.Bytes())
+		if assert.NoError(t, err) {
+			assert.Equal(t, testExtractor, metadata.Extractor)
+			assert.Nil(t, metadata.Meta)
+		}
+	}
+}
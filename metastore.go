@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Store for the metadata of documents and everything kept alongside it:
+// versions, indexes and blob references. It holds named buckets of keys and
+// values sorted by key, which may be nested, read and changed in
+// transactions. A read-write transaction must not start another
+// transaction.
+type metaStore interface {
+	// Run a read-only transaction.
+	view(fn func(metaTx) error) error
+	// Run a read-write transaction, committed if fn returns nil and rolled
+	// back otherwise.
+	update(fn func(metaTx) error) error
+	close() error
+}
+
+// Transaction on a metadata store. Keys and values it returns are only
+// valid until it ends.
+type metaTx interface {
+	// Get a top-level bucket, or nil if there is none.
+	bucket(name []byte) metaBucket
+	createBucket(name []byte) (metaBucket, error)
+	deleteBucket(name []byte) error
+}
+
+// Bucket of keys and values, and of nested buckets, sorted by key.
+type metaBucket interface {
+	// Get the value of a key, or nil if there is none.
+	get(key []byte) []byte
+	put(key, value []byte) error
+	delete(key []byte) error
+	// Call a function for each key in order. Nested buckets have a nil
+	// value.
+	forEach(fn func(k, v []byte) error) error
+	// Get a cursor to scan the bucket in key order.
+	cursor() metaCursor
+	// Get a nested bucket, or nil if there is none.
+	bucket(name []byte) metaBucket
+	createBucketIfNotExists(name []byte) (metaBucket, error)
+	deleteBucket(name []byte) error
+}
+
+// Cursor scanning a bucket in key order. Each method returns the key and
+// value of an entry, or a nil key past the end.
+type metaCursor interface {
+	first() (k, v []byte)
+	// Move to the first key at or after seek.
+	seek(seek []byte) (k, v []byte)
+	next() (k, v []byte)
+}
+
+// Names of the metadata store implementations, for the -metadata flag.
+const (
+	boltMetadata   = "bolt"
+	memoryMetadata = "memory"
+)
+
+// Errors returned by metadata stores.
+var (
+	errBucketNotFound = errors.New("bucket not found")
+	errBucketExists   = errors.New("bucket already exists")
+	errTxNotWritable  = errors.New("transaction not writable")
+)
+
+// Create the metadata store for an implementation name, with the top-level
+// buckets. The bolt store is kept in the database file.
+func newMetaStore(name, dbFile string, buckets ...[]byte) (metaStore, error) {
+	switch name {
+	case boltMetadata:
+		return openBoltStore(dbFile, buckets...)
+	case memoryMetadata:
+		return newMemoryMetaStore(buckets...), nil
+	}
+	return nil, fmt.Errorf("unknown metadata store %s", name)
+}
+
+// Metadata store in a bolt database file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// Open a bolt database file, creating it and the top-level buckets as
+// needed. Waits for a while if another process has the database open.
+func openBoltStore(f string, buckets ...[]byte) (*boltStore, error) {
+	db, err := bolt.Open(f, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db}, nil
+}
+
+func (s *boltStore) view(fn func(metaTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+func (s *boltStore) update(fn func(metaTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+func (s *boltStore) close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// Wrap a bolt bucket, keeping a missing one nil.
+func wrapBoltBucket(b *bolt.Bucket) metaBucket {
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+// Translate bolt errors to the errors of metadata stores.
+func boltError(err error) error {
+	switch err {
+	case bolt.ErrBucketNotFound:
+		return errBucketNotFound
+	case bolt.ErrBucketExists:
+		return errBucketExists
+	case bolt.ErrTxNotWritable:
+		return errTxNotWritable
+	}
+	return err
+}
+
+func (t boltTx) bucket(name []byte) metaBucket {
+	return wrapBoltBucket(t.tx.Bucket(name))
+}
+
+func (t boltTx) createBucket(name []byte) (metaBucket, error) {
+	b, err := t.tx.CreateBucket(name)
+	return wrapBoltBucket(b), boltError(err)
+}
+
+func (t boltTx) deleteBucket(name []byte) error {
+	return boltError(t.tx.DeleteBucket(name))
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+func (b boltBucket) get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltBucket) put(key, value []byte) error {
+	return boltError(b.b.Put(key, value))
+}
+
+func (b boltBucket) delete(key []byte) error {
+	return boltError(b.b.Delete(key))
+}
+
+func (b boltBucket) forEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b boltBucket) cursor() metaCursor {
+	return boltCursor{b.b.Cursor()}
+}
+
+func (b boltBucket) bucket(name []byte) metaBucket {
+	return wrapBoltBucket(b.b.Bucket(name))
+}
+
+func (b boltBucket) createBucketIfNotExists(name []byte) (metaBucket, error) {
+	nested, err := b.b.CreateBucketIfNotExists(name)
+	return wrapBoltBucket(nested), boltError(err)
+}
+
+func (b boltBucket) deleteBucket(name []byte) error {
+	return boltError(b.b.DeleteBucket(name))
+}
+
+type boltCursor struct {
+	c *bolt.Cursor
+}
+
+func (c boltCursor) first() ([]byte, []byte) {
+	return c.c.First()
+}
+
+func (c boltCursor) seek(seek []byte) ([]byte, []byte) {
+	return c.c.Seek(seek)
+}
+
+func (c boltCursor) next() ([]byte, []byte) {
+	return c.c.Next()
+}
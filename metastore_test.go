@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+var testMetaBucket = []byte("Test")
+
+// Keys of a bucket in cursor order, from a seek key if there is one.
+func testScan(b metaBucket, seek []byte) []string {
+	var keys []string
+	c := b.cursor()
+	k, _ := c.first()
+	if seek != nil {
+		k, _ = c.seek(seek)
+	}
+	for ; k != nil; k, _ = c.next() {
+		keys = append(keys, string(k))
+	}
+	return keys
+}
+
+// Read, change and scan buckets, and roll back a failed transaction.
+func testMetaStore(t *testing.T, store metaStore) {
+	err := store.update(func(tx metaTx) error {
+		b := tx.bucket(testMetaBucket)
+		for _, k := range []string{"c", "a", "b", "d"} {
+			if err := b.put([]byte(k), []byte("value "+k)); err != nil {
+				return err
+			}
+		}
+		nested, err := b.createBucketIfNotExists([]byte("bb"))
+		if err != nil {
+			return err
+		}
+		return nested.put([]byte("x"), []byte("nested"))
+	})
+	assert.NoError(t, err)
+
+	err = store.view(func(tx metaTx) error {
+		assert.Nil(t, tx.bucket([]byte("Missing")))
+		b := tx.bucket(testMetaBucket)
+		assert.Equal(t, "value a", string(b.get([]byte("a"))))
+		assert.Nil(t, b.get([]byte("missing")))
+		assert.Nil(t, b.get([]byte("bb")), "A nested bucket has no value")
+		assert.Nil(t, b.bucket([]byte("missing")))
+		assert.Equal(t, "nested", string(b.bucket([]byte("bb")).get([]byte("x"))))
+		assert.Equal(t, []string{"a", "b", "bb", "c", "d"}, testScan(b, nil))
+		assert.Equal(t, []string{"bb", "c", "d"}, testScan(b, []byte("ba")))
+		assert.Empty(t, testScan(b, []byte("e")))
+		var forEach []string
+		err := b.forEach(func(k, v []byte) error {
+			forEach = append(forEach, string(k)+"="+string(v))
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a=value a", "b=value b", "bb=", "c=value c", "d=value d"}, forEach)
+		assert.Equal(t, errTxNotWritable, b.put([]byte("e"), nil))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	failed := errors.New("failed")
+	err = store.update(func(tx metaTx) error {
+		b := tx.bucket(testMetaBucket)
+		assert.NoError(t, b.put([]byte("a"), []byte("changed")))
+		assert.NoError(t, b.put([]byte("e"), []byte("added")))
+		assert.NoError(t, b.delete([]byte("c")))
+		assert.NoError(t, b.deleteBucket([]byte("bb")))
+		_, err := tx.createBucket([]byte("Created"))
+		assert.NoError(t, err)
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	err = store.view(func(tx metaTx) error {
+		b := tx.bucket(testMetaBucket)
+		assert.Equal(t, "value a", string(b.get([]byte("a"))), "Changes should be rolled back")
+		assert.Equal(t, []string{"a", "b", "bb", "c", "d"}, testScan(b, nil))
+		assert.NotNil(t, b.bucket([]byte("bb")))
+		assert.Nil(t, tx.bucket([]byte("Created")))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	err = store.update(func(tx metaTx) error {
+		b := tx.bucket(testMetaBucket)
+		c := b.cursor()
+		// Deleting the current key keeps the cursor in order.
+		for k, _ := c.first(); k != nil; k, _ = c.next() {
+			if string(k) != "bb" {
+				assert.NoError(t, b.delete(k))
+			}
+		}
+		assert.Equal(t, errBucketNotFound, b.deleteBucket([]byte("missing")))
+		assert.Equal(t, errBucketNotFound, tx.deleteBucket([]byte("Missing")))
+		_, err := tx.createBucket(testMetaBucket)
+		assert.Equal(t, errBucketExists, err)
+		return b.deleteBucket([]byte("bb"))
+	})
+	assert.NoError(t, err)
+	err = store.view(func(tx metaTx) error {
+		assert.Empty(t, testScan(tx.bucket(testMetaBucket), nil))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, store.close())
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	store, err := openBoltStore(path.Join(dir, "test.db"), testMetaBucket)
+	if assert.NoError(t, err) {
+		testMetaStore(t, store)
+	}
+}
+
+func TestMemoryMetaStore(t *testing.T) {
+	testMetaStore(t, newMemoryMetaStore(testMetaBucket))
+
+	store := newMemoryMetaStore(testMetaBucket)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.update(func(tx metaTx) error {
+				return tx.bucket(testMetaBucket).put([]byte(strconv.Itoa(i)), []byte{})
+			})
+			store.view(func(tx metaTx) error {
+				testScan(tx.bucket(testMetaBucket), nil)
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	store.view(func(tx metaTx) error {
+		assert.Len(t, testScan(tx.bucket(testMetaBucket), nil), 10)
+		return nil
+	})
+}
+
+// Save, list, search and delete a document with the memory metadata store
+// in use.
+func TestMemoryMetaStoreHandlers(t *testing.T) {
+	saved := db
+	db = newMemoryMetaStore(dbBuckets...)
+	defer func() { db = saved }()
+
+	gofight.New().POST("/document/"+testStoreKey).
+		SetHeader(gofight.H{"Content-Type": "text/plain"}).
+		SetBody(testContent).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	gofight.New().GET("/document/"+testStoreKey+"/metadata").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), `"content-type":"text/plain"`)
+		})
+	gofight.New().GET("/documents?content-type=text/plain").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), testStoreKey)
+		})
+	gofight.New().GET("/search?q=plain").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Contains(t, r.Body.String(), testStoreKey)
+		})
+	cleanupDoc(t, testStoreKey)
+	gofight.New().GET("/document/"+testStoreKey+"/metadata").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotFound, r.Code)
+		})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// Maximum number of ids in a multi-get or multi-delete request.
+	maxMultiIDs = 10000
+	// Number of result items written between flushes of a streamed
+	// response.
+	multiFlushInterval = 20
+)
+
+// Request body of a multi-get or multi-delete.
+type multiRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// Get many documents and metadata. The request body is a JSON object with
+// the list of "ids". The response has an item per id, in order, like the
+// response for getting that document; a missing document gives an item
+// with ok false rather than failing the request.
+func multiGetDocs(c echo.Context) error {
+	return multiDocs(c, readDocument)
+}
+
+// Remove many documents. The request body is a JSON object with the list of
+// "ids". The response has an item per id, in order, like the response for
+// removing that document.
+func multiDeleteDocs(c echo.Context) error {
+	return multiDocs(c, func(key string) (int, *ResponseType) {
+		return removeDocument(key, "")
+	})
+}
+
+// Apply an operation to each id of a multi-document request, streaming the
+// result items as they are ready so a large batch is not held in memory.
+func multiDocs(c echo.Context, op func(key string) (int, *ResponseType)) error {
+	body := c.Request().Body
+	defer body.Close()
+	var req multiRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return c.JSON(statusBadRequest, newErrorResp("", "input error", fmt.Errorf("error reading ids: %s", err)))
+	}
+	if len(req.IDs) > maxMultiIDs {
+		return c.JSON(statusBadRequest, newErrorResp("", "input error", fmt.Errorf("at most %d ids are allowed", maxMultiIDs)))
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	w.WriteHeader(statusOk)
+	if _, err := w.Write([]byte(`{"ok":"true","items":[`)); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for i, key := range req.IDs {
+		if i > 0 {
+			if _, err := w.Write([]byte(",")); err != nil {
+				return err
+			}
+		}
+		var res *ResponseType
+		if err := validateKey(key); err != nil {
+			res = newErrorResp(key, "invalid key", err)
+		} else {
+			_, res = op(key)
+		}
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+		if (i+1)%multiFlushInterval == 0 {
+			flush(w)
+		}
+	}
+	_, err := w.Write([]byte("]}"))
+	return err
+}
+
+// Flush a streamed response, if the writer supports it.
+func flush(w *echo.Response) {
+	if f, ok := w.Writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
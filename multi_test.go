@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiGetAndDeleteDocs(t *testing.T) {
+	keys := []string{"multi-1", "multi-2"}
+	for _, key := range keys {
+		gofight.New().POST("/document/"+key).
+			SetQuery(gofight.H{
+				"extractor": testExtractor,
+			}).
+			SetBody(testJSON).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+	}
+
+	gofight.New().POST("/documents/_mget").
+		SetBody(`{"ids": ["multi-1", "missing-key", "multi-2"]}`).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) && assert.Len(t, resp.Items, 3) {
+				assert.True(t, resp.Ok)
+				assert.True(t, resp.Items[0].Ok)
+				assert.JSONEq(t, testJSON, resp.Items[0].Document)
+				assert.Equal(t, testExtractor, resp.Items[0].Extractor)
+				assert.False(t, resp.Items[1].Ok, "Missing key should fail")
+				assert.Equal(t, "key not found", resp.Items[1].Message)
+				assert.Equal(t, "multi-2", resp.Items[2].Key)
+			}
+		})
+
+	gofight.New().POST("/documents/_mdelete").
+		SetBody(`{"ids": ["multi-1", "multi-2", "missing-key"]}`).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) && assert.Len(t, resp.Items, 3) {
+				assert.True(t, resp.Items[0].Ok)
+				assert.True(t, resp.Items[1].Ok)
+				assert.False(t, resp.Items[2].Ok, "Missing key should fail")
+			}
+		})
+	for _, key := range keys {
+		_, err := os.Stat(dataDir + "/" + key)
+		assert.True(t, os.IsNotExist(err), "Document should be removed")
+		_, err = getMetadata(key)
+		assert.Equal(t, errKeyNotFound, err)
+	}
+
+	gofight.New().POST("/documents/_mget").
+		SetBody(`["multi-1"]`).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/labstack/echo"
+	"github.com/satori/go.uuid"
+)
+
+// Maximum bytes of a multipart upload kept in memory. Larger files are
+// buffered in temporary files while the request is parsed.
+const multipartMemory = 32 << 20
+
+// Check if a request is a multipart/form-data upload.
+func isMultipartUpload(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get(echo.HeaderContentType))
+	return err == nil && mediaType == echo.MIMEMultipartForm
+}
+
+// Save the documents uploaded as the file parts of a multipart/form-data
+// request. The filename and content type of each part become its name and
+// content type, and the other form fields become metadata of every file.
+// Each file gets a new v4 UUID, except that a single file is stored under
+// the given key. Several files return one response item per file.
+func saveMultipartDocuments(key string, c echo.Context, overwrite bool) (int, *ResponseType) {
+	r := c.Request()
+	defer r.Body.Close()
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		return statusBadRequest, newErrorResp(key, "input error", fmt.Errorf("error reading multipart upload: %s", err))
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// Form fields take precedence over query parameters.
+	values := url.Values{}
+	for name, v := range r.MultipartForm.Value {
+		values[name] = v
+	}
+	for name, v := range r.URL.Query() {
+		if _, ok := values[name]; !ok {
+			values[name] = v
+		}
+	}
+
+	var fields []string
+	for field := range r.MultipartForm.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var files []*multipart.FileHeader
+	for _, field := range fields {
+		files = append(files, r.MultipartForm.File[field]...)
+	}
+	switch {
+	case len(files) == 0:
+		return statusBadRequest, newErrorResp(key, "input error", fmt.Errorf("no file uploaded"))
+	case len(files) > 1 && key != "":
+		return statusBadRequest, newErrorResp(key, "input error", fmt.Errorf("only one file can be uploaded for key %s", key))
+	}
+
+	code := statusOk
+	items := make([]*ResponseType, 0, len(files))
+	for _, fh := range files {
+		k := key
+		if k == "" {
+			k = uuid.NewV4().String()
+		}
+		itemCode, res := saveMultipartFile(k, fh, values, r.Header, uploadOptions(values, r.Header, overwrite))
+		if itemCode != statusOk && code == statusOk {
+			code = itemCode
+		}
+		items = append(items, res)
+	}
+	if len(items) == 1 {
+		return code, items[0]
+	}
+	res := newSuccessResp("", fmt.Sprintf("saved %d documents", len(items)))
+	if code != statusOk {
+		res = newErrorResp("", "input error", fmt.Errorf("some documents were not saved"))
+	}
+	res.Items = items
+	return code, res
+}
+
+// Save a file part of a multipart upload. The Content-MD5 and Digest headers
+// of the part, rather than the request, are checked against its contents.
+func saveMultipartFile(key string, fh *multipart.FileHeader, values url.Values, header http.Header, opts saveOptions) (int, *ResponseType) {
+	f, err := fh.Open()
+	if err != nil {
+		return statusErr, newErrorResp(key, "file read error", fmt.Errorf("error reading uploaded file %s: %s", fh.Filename, err))
+	}
+	defer f.Close()
+	metadata := uploadMetadata(values, header)
+	if fh.Filename != "" {
+		metadata.Name = fh.Filename
+	}
+	metadata.ContentType = fh.Header.Get(echo.HeaderContentType)
+	digests, err := expectedDigests(http.Header(fh.Header))
+	if err != nil {
+		return statusBadRequest, newErrorResp(key, "input error", fmt.Errorf("%s: %s", fh.Filename, err))
+	}
+	opts.digests = digests
+	return storeDocument(key, f, metadata, opts)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+// Build a multipart/form-data body with the given form fields and files,
+// by file name. Returns the body and its content type.
+func multipartBody(t *testing.T, fields map[string]string, files map[string]string) (string, string) {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	for name, value := range fields {
+		assert.NoError(t, w.WriteField(name, value))
+	}
+	for name, content := range files {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+		h.Set("Content-Type", "text/plain")
+		part, err := w.CreatePart(h)
+		if assert.NoError(t, err) {
+			part.Write([]byte(content))
+		}
+	}
+	assert.NoError(t, w.Close())
+	return buf.String(), w.FormDataContentType()
+}
+
+func TestPostMultipartDoc(t *testing.T) {
+	key := "multipart-123"
+	body, contentType := multipartBody(t,
+		map[string]string{"extractor": testExtractor, "source": "feed-a"},
+		map[string]string{"report.txt": testContent})
+	gofight.New().POST("/document/"+key).
+		SetHeader(gofight.H{
+			"Content-Type": contentType,
+		}).
+		SetBody(body).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, key)
+
+	gofight.New().GET("/document/"+key).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.Equal(t, testContent, resp.Document, "Only the file part should be stored")
+				assert.Equal(t, "report.txt", resp.Name)
+				assert.Equal(t, "text/plain", resp.ContentType)
+				assert.Equal(t, testExtractor, resp.Extractor)
+				assert.Equal(t, map[string]string{"source": "feed-a"}, resp.Meta)
+			}
+		})
+}
+
+func TestPostMultipartDocs(t *testing.T) {
+	body, contentType := multipartBody(t,
+		map[string]string{"extractor": testExtractor},
+		map[string]string{"a.txt": "first file", "b.txt": "second file"})
+	gofight.New().POST("/document").
+		SetHeader(gofight.H{
+			"Content-Type": contentType,
+		}).
+		SetBody(body).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) && assert.Len(t, resp.Items, 2) {
+				assert.True(t, resp.Ok, "Response ok should be true")
+				for _, item := range resp.Items {
+					assert.True(t, item.Ok, "Item ok should be true")
+					metadata, err := getMetadata(item.Key)
+					if assert.NoError(t, err) {
+						assert.Contains(t, []string{"a.txt", "b.txt"}, metadata.Name)
+						assert.Equal(t, testExtractor, metadata.Extractor)
+					}
+					cleanupDoc(t, item.Key)
+				}
+			}
+		})
+
+	// Several files cannot share one id.
+	gofight.New().POST("/document/multipart-456").
+		SetHeader(gofight.H{
+			"Content-Type": contentType,
+		}).
+		SetBody(body).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		})
+}
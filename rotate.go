@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Messages of key rotation status responses.
+const (
+	rotationRunning  = "rotation running"
+	rotationFinished = "rotation finished"
+	rotationIdle     = "no rotation"
+)
+
+var errNoKeyring = errors.New("no keyring to encrypt with")
+
+// State of the key rotation started last.
+var rotation struct {
+	sync.Mutex
+	started bool
+	running bool
+	// Number of records re-encrypted so far.
+	rotated int
+	err     error
+}
+
+// Interval between key rotation status requests of the rotate-keys command.
+var rotationPollInterval = time.Second
+
+// Metadata record whose contents are re-encrypted by a key rotation.
+type rotationRecord struct {
+	key string
+	// Database key of an earlier version, or nil for the current one.
+	version  []byte
+	v        []byte
+	metadata *DocMetadata
+}
+
+// Get the bucket holding a record within a transaction, or nil if there is
+// none.
+func (r *rotationRecord) bucket(tx metaTx) metaBucket {
+	if r.version == nil {
+		return tx.bucket(dbBucket)
+	}
+	return tx.bucket(versionsBucket).bucket([]byte(r.key))
+}
+
+// Get the database key of a record in its bucket.
+func (r *rotationRecord) recordKey() []byte {
+	if r.version == nil {
+		return []byte(r.key)
+	}
+	return r.version
+}
+
+// Find the records of documents and earlier versions whose contents are not
+// encrypted with a key. Documents stored before contents were deduplicated
+// keep their unencrypted file, and are left out.
+func findRotationRecords(id string) ([]*rotationRecord, error) {
+	var records []*rotationRecord
+	add := func(key string, version, v []byte) {
+		metadata, err := decodeMetadata(v)
+		if err != nil || metadata.SHA256 == "" || metadata.KeyID == id {
+			return
+		}
+		if version != nil {
+			version = append([]byte{}, version...)
+		}
+		records = append(records, &rotationRecord{key: key, version: version, v: append([]byte{}, v...), metadata: metadata})
+	}
+	err := db.view(func(tx metaTx) error {
+		err := tx.bucket(dbBucket).forEach(func(k, v []byte) error {
+			add(string(k), nil, v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		versions := tx.bucket(versionsBucket)
+		return versions.forEach(func(k, _ []byte) error {
+			b := versions.bucket(k)
+			if b == nil {
+				return nil
+			}
+			return b.forEach(func(vk, v []byte) error {
+				add(string(k), vk, v)
+				return nil
+			})
+		})
+	})
+	return records, err
+}
+
+// Re-encrypt the contents of a record with the current key. A record that
+// changed in the meantime is read again: if it still refers to the same
+// contents, such as after a metadata update, they are re-encrypted all the
+// same. Otherwise it is left for rotateKeys to find again, unless it is
+// encrypted with the current key already. The metadata keeps its revision,
+// so the ETag does not change. Returns whether the record was re-encrypted.
+func rotateRecord(r *rotationRecord) (bool, error) {
+	src, err := decryptContents(r.metadata, func() (blobReader, error) { return openBlob(r.metadata) })
+	if os.IsNotExist(err) {
+		// Removed in the meantime, or left for fsck.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	f, err := ioutil.TempFile(dataDir, uploadPrefix)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, src)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	metadata := *r.metadata
+	tmpPath, err := encryptContents(&metadata, f.Name())
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	doc := &pendingDocument{key: r.key, metadata: &metadata, tmpPath: tmpPath}
+	defer os.Remove(doc.tmpPath)
+	done, err := uploadContents(doc)
+	if err != nil {
+		return false, err
+	}
+	if done != nil {
+		defer done()
+	}
+	rotated := false
+	err = updateBlobs(func(tx metaTx) error {
+		b := r.bucket(tx)
+		if b == nil {
+			return nil
+		}
+		v := b.get(r.recordKey())
+		if v == nil {
+			// Removed, or replaced by a new document and found again as
+			// an earlier version.
+			return nil
+		}
+		previous := r.metadata
+		if !bytes.Equal(v, r.v) {
+			current, err := decodeMetadata(v)
+			if err != nil || current.KeyID == doc.metadata.KeyID || blobName(current) != blobName(r.metadata) {
+				return nil
+			}
+			updated := *current
+			updated.KeyID, updated.BlobDigest, updated.Inline = doc.metadata.KeyID, doc.metadata.BlobDigest, doc.metadata.Inline
+			previous, doc.metadata = current, &updated
+		}
+		if err := putContents(tx, doc); err != nil {
+			return err
+		}
+		buf, err := encodeMetadata(doc.metadata)
+		if err != nil {
+			return err
+		}
+		if err = moveBlobRef(tx, previous, doc.metadata); err != nil {
+			return err
+		}
+		// Documents indexed before they were encrypted are taken out of
+		// the index.
+		if r.version == nil && !indexesText(doc.metadata) {
+			if err = unindexText(tx, r.key); err != nil {
+				return err
+			}
+		}
+		rotated = true
+		return b.put(r.recordKey(), buf)
+	})
+	return rotated, err
+}
+
+// Re-encrypt the contents of all documents and earlier versions that are
+// not encrypted with the current key, a record at a time, while the service
+// is running. The records are listed again until a pass re-encrypts none,
+// so records changed during a pass, and earlier versions made by replacing
+// a document, are re-encrypted too; what is left then cannot be read.
+// Returns the number of records re-encrypted.
+func rotateKeys() (int, error) {
+	id, aead := currentKey()
+	if aead == nil {
+		return 0, errNoKeyring
+	}
+	n := 0
+	for {
+		records, err := findRotationRecords(id)
+		if err != nil {
+			return n, err
+		}
+		pass := n
+		for _, r := range records {
+			rotated, err := rotateRecord(r)
+			if err != nil {
+				return n, fmt.Errorf("error re-encrypting %s: %s", r.key, err)
+			}
+			if rotated {
+				n++
+				rotation.Lock()
+				rotation.rotated = n
+				rotation.Unlock()
+			}
+		}
+		if n == pass {
+			return n, nil
+		}
+	}
+}
+
+// Get the response describing the key rotation started last.
+func rotationResp() *ResponseType {
+	rotation.Lock()
+	defer rotation.Unlock()
+	var r *ResponseType
+	switch {
+	case !rotation.started:
+		r = newSuccessResp("", rotationIdle)
+	case rotation.running:
+		r = newSuccessResp("", rotationRunning)
+	case rotation.err != nil:
+		r = newErrorResp("", rotationFinished, rotation.err)
+	default:
+		r = newSuccessResp("", rotationFinished)
+	}
+	r.Total = rotation.rotated
+	return r
+}
+
+// Reload the keyring file, then start re-encrypting all documents with its
+// current key in the background. Responds with 202 Accepted, or 409
+// Conflict if a rotation is already running. Its progress is reported by
+// getKeyRotation.
+func startKeyRotation(c echo.Context) error {
+	if err := reloadKeyring(); err != nil {
+		return c.JSON(statusErr, newErrorResp("", "error loading keyring", err))
+	}
+	if _, aead := currentKey(); aead == nil {
+		return c.JSON(statusBadRequest, newErrorResp("", "encryption not enabled", errNoKeyring))
+	}
+	rotation.Lock()
+	if rotation.running {
+		rotation.Unlock()
+		return c.JSON(statusConflict, rotationResp())
+	}
+	rotation.started, rotation.running, rotation.rotated, rotation.err = true, true, 0, nil
+	rotation.Unlock()
+	go func() {
+		n, err := rotateKeys()
+		rotation.Lock()
+		rotation.running, rotation.rotated, rotation.err = false, n, err
+		rotation.Unlock()
+	}()
+	return c.JSON(http.StatusAccepted, rotationResp())
+}
+
+// Get the progress of the key rotation started last.
+func getKeyRotation(c echo.Context) error {
+	return c.JSON(statusOk, rotationResp())
+}
+
+// Ask the service at a base URL to rotate keys, and wait for the rotation
+// to finish. Returns the number of records re-encrypted.
+func requestKeyRotation(baseURL string) (int, error) {
+	resp, err := http.Post(baseURL+"/keys/rotate", "", nil)
+	for {
+		if err != nil {
+			return 0, err
+		}
+		var r ResponseType
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+		switch {
+		case err != nil:
+			return 0, err
+		case !r.Ok:
+			return r.Total, fmt.Errorf("%s: %s", r.Message, r.Error)
+		case r.Message != rotationRunning:
+			return r.Total, nil
+		}
+		time.Sleep(rotationPollInterval)
+		resp, err = http.Get(baseURL + "/keys/rotate")
+	}
+}
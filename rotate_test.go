@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testRotateKey      = "rotate-123"
+	testRotatePlainKey = "rotate-plain-123"
+)
+
+// Get the key ids of the earlier versions of a document.
+func testVersionKeyIDs(t *testing.T, key string) []string {
+	var ids []string
+	err := db.view(func(tx metaTx) error {
+		b := tx.bucket(versionsBucket).bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		return b.forEach(func(_, v []byte) error {
+			metadata, err := decodeMetadata(v)
+			if err == nil {
+				ids = append(ids, metadata.KeyID)
+			}
+			return err
+		})
+	})
+	assert.NoError(t, err)
+	return ids
+}
+
+func TestKeyRotation(t *testing.T) {
+	gofight.New().GET("/keys/rotate").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	gofight.New().POST("/keys/rotate").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+			assert.Contains(t, r.Body.String(), "encryption not enabled")
+		})
+
+	// An unencrypted version, and a document encrypted with k1, and an
+	// unencrypted text document indexed for search.
+	gofight.New().POST("/document/"+testRotateKey).
+		SetBody("first contents").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testRotateKey)
+	gofight.New().POST("/document/"+testRotatePlainKey).
+		SetHeader(gofight.H{"Content-Type": "text/plain"}).
+		SetBody("rotatable plain text").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	defer cleanupDoc(t, testRotatePlainKey)
+	found, _ := searchKeys(t, "rotatable")
+	assert.Equal(t, []string{testRotatePlainKey}, found)
+	restore := useTestKeyring(t, "k1", "k1")
+	defer restore()
+	gofight.New().PUT("/document/"+testRotateKey).
+		SetBody("second contents").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	etag := testETag(t, testRotateKey)
+
+	// Rotate to k2, keeping k1 to read the contents until they are
+	// re-encrypted.
+	writeTestKeyring(t, keyringPath, "k2", "k1", "k2")
+	server := httptest.NewServer(engine)
+	defer server.Close()
+	saved := rotationPollInterval
+	rotationPollInterval = 10 * time.Millisecond
+	defer func() { rotationPollInterval = saved }()
+	n, err := requestKeyRotation(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	metadata, err := getMetadata(testRotateKey)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "k2", metadata.KeyID)
+	}
+	assert.Equal(t, []string{"k2"}, testVersionKeyIDs(t, testRotateKey))
+	metadata, err = getMetadata(testRotatePlainKey)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "k2", metadata.KeyID)
+	}
+	found, _ = searchKeys(t, "rotatable")
+	assert.Empty(t, found, "Encrypted documents should be taken out of the index")
+	assert.Equal(t, etag, testETag(t, testRotateKey), "Rotation should not change documents")
+	for _, name := range testListBlobs(t, blobs) {
+		assert.NotContains(t, name, ".k1"+encryptedBlobSuffix, "Blobs encrypted with k1 should be removed")
+	}
+
+	// Only k2 is needed to read the contents now.
+	writeTestKeyring(t, keyringPath, "k2", "k2")
+	assert.NoError(t, reloadKeyring())
+	gofight.New().GET("/document/"+testRotateKey+"/content").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "second contents", r.Body.String())
+		})
+	assert.Contains(t, testVersionContents(t, testRotateKey, 1), "first contents")
+	f := &fsck{}
+	if assert.NoError(t, f.run()) {
+		assert.Empty(t, f.problems)
+	}
+
+	// Nothing is left to re-encrypt.
+	n, err = requestKeyRotation(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestKeyRotationRace(t *testing.T) {
+	const patched, replaced = "rotate-race-1", "rotate-race-2"
+	defer useTestKeyring(t, "k1", "k1")()
+	for _, key := range []string{patched, replaced} {
+		gofight.New().POST("/document/"+key).
+			SetBody("contents of "+key).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+		defer cleanupDoc(t, key)
+	}
+	writeTestKeyring(t, keyringPath, "k2", "k1", "k2")
+	assert.NoError(t, reloadKeyring())
+
+	// Hold the rotation while re-encrypting the first document, once both
+	// records are listed.
+	metadata, err := getMetadata(patched)
+	if !assert.NoError(t, err) {
+		return
+	}
+	metadata.KeyID = "k2"
+	metadata.BlobDigest, err = blobDigest("k2", metadata.SHA256)
+	assert.NoError(t, err)
+	saved := blobs
+	store := slowBlobStore{blobStore: saved, name: blobName(metadata), started: make(chan struct{}), release: make(chan struct{})}
+	blobs = store
+	defer func() { blobs = saved }()
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		n, err := rotateKeys()
+		done <- result{n, err}
+	}()
+	<-store.started
+
+	// A metadata update keeps the contents encrypted with k1, and a new
+	// document moves them to an earlier version.
+	gofight.New().PATCH("/document/"+patched+"/metadata").
+		SetBody(`{"title": "patched"}`).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	gofight.New().PUT("/document/"+replaced).
+		SetBody("new contents").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	close(store.release)
+	res := <-done
+	assert.NoError(t, res.err)
+	// The patched document, and the earlier version of the replaced one.
+	assert.Equal(t, 2, res.n)
+
+	metadata, err = getMetadata(patched)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "k2", metadata.KeyID)
+		assert.Equal(t, "patched", metadata.Title, "Metadata updates should be kept")
+	}
+	metadata, err = getMetadata(replaced)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "k2", metadata.KeyID)
+	}
+	assert.Equal(t, []string{"k2"}, testVersionKeyIDs(t, replaced))
+	for _, name := range testListBlobs(t, saved) {
+		assert.NotContains(t, name, ".k1"+encryptedBlobSuffix, "Blobs encrypted with k1 should be removed")
+	}
+	f := &fsck{}
+	if assert.NoError(t, f.run()) {
+		assert.Empty(t, f.problems)
+	}
+}
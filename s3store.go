@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hex SHA-256 digest of an empty payload, for signing requests without a
+// body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Prefix of the names of quarantined objects, after the configured prefix.
+// Blob names have no slash, so they are not listed as blobs.
+const s3QuarantinePrefix = ".quarantine/"
+
+// Blob store keeping blobs as objects in a bucket of an S3-compatible
+// service, named by their digest after a prefix. Requests are signed with
+// AWS Signature Version 4 when there are credentials, and the bucket is
+// addressed in the path, which S3-compatible services generally support.
+type s3BlobStore struct {
+	s3Settings
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newS3BlobStore(s s3Settings) (*s3BlobStore, error) {
+	if s.bucket == "" {
+		return nil, errors.New("no S3 bucket")
+	}
+	endpoint, err := url.Parse(s.endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %s", s.endpoint)
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	return &s3BlobStore{s3Settings: s, endpoint: endpoint, client: &http.Client{}}, nil
+}
+
+// Escape a string for a URL path or query as S3 signatures expect: every
+// byte except letters, digits and "-._~" is percent-encoded, and so is "/"
+// unless keepSlash is set.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 || c == '/' && keepSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Encode query parameters in sorted order, as S3 signatures expect.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign a request with AWS Signature Version 4, given the hex SHA-256 digest
+// of its body. The host, Range and x-amz-* headers are signed.
+func signV4(req *http.Request, region, accessKey, secretKey, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// Send a request for an object, or for the bucket if name is "". A missing
+// object gives an error for which os.IsNotExist is true, and any other
+// unsuccessful status an error with the response body.
+func (s *s3BlobStore) do(method, name string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := *s.endpoint
+	p := strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if name != "" {
+		p += "/" + s.prefix + name
+	}
+	u.Path = p
+	u.RawPath = s3Escape(p, true)
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.accessKey != "" {
+		signV4(req, s.region, s.accessKey, s.secretKey, payloadHash, time.Now())
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("S3 %s %s: %s %s", method, u.Path, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// Upload the file, signed with its SHA-256 digest so the service checks it.
+// The digest is computed from the file, as blobs of compressed or encrypted
+// contents are named after the digest of the original contents.
+func (s *s3BlobStore) put(digest, filePath string) error {
+	_, err := s.size(digest)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := s.do("PUT", digest, nil, nil, f, size, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3BlobStore) open(digest string) (blobReader, error) {
+	size, err := s.size(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobReader{store: s, name: digest, size: size}, nil
+}
+
+func (s *s3BlobStore) size(digest string) (int64, error) {
+	resp, err := s.do("HEAD", digest, nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (s *s3BlobStore) remove(digest string) error {
+	resp, err := s.do("DELETE", digest, nil, nil, nil, 0, emptyPayloadHash)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Result of listing the objects of a bucket.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3BlobStore) list(fn func(digest string) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s.prefix)
+			if strings.Contains(name, "/") {
+				continue
+			}
+			if err = fn(name); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Copy the blob under s3QuarantinePrefix, then remove it.
+func (s *s3BlobStore) quarantine(digest string) error {
+	header := http.Header{"X-Amz-Copy-Source": {s3Escape("/"+s.bucket+"/"+s.prefix+digest, true)}}
+	resp, err := s.do("PUT", s3QuarantinePrefix+digest, nil, header, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.remove(digest)
+}
+
+// Contents of an object being read. Each read after a seek starts a ranged
+// request from the current offset, so ranges of large blobs are served
+// without downloading the whole blob.
+type s3BlobReader struct {
+	store *s3BlobStore
+	name  string
+	size  int64
+	off   int64
+	body  io.ReadCloser
+}
+
+func (r *s3BlobReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		header := http.Header{"Range": {"bytes=" + strconv.FormatInt(r.off, 10) + "-"}}
+		resp, err := r.store.do("GET", r.name, nil, header, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && r.off > 0 {
+			resp.Body.Close()
+			return 0, fmt.Errorf("S3 GET %s: range not supported", r.name)
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.off += int64(n)
+	if err == io.EOF && r.off < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3BlobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != r.off && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *s3BlobReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
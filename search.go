@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// Default number of search results returned.
+	defaultSearchLimit = 10
+	// Maximum number of search results returned.
+	maxSearchLimit = 100
+	// BM25 term frequency saturation.
+	bm25K1 = 1.2
+	// BM25 document length normalization.
+	bm25B = 0.75
+	// Number of terms of context shown around a match in a snippet.
+	snippetContext = 12
+)
+
+// SearchResult struct for a document matching a search, with its metadata.
+type SearchResult struct {
+	DocumentEntry
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet,omitempty"`
+}
+
+// Search results ordered by descending score, then by key.
+type searchResults []*SearchResult
+
+func (r searchResults) Len() int      { return len(r) }
+func (r searchResults) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r searchResults) Less(i, j int) bool {
+	if r[i].Score != r[j].Score {
+		return r[i].Score > r[j].Score
+	}
+	return r[i].Key < r[j].Key
+}
+
+// Node of a parsed search query.
+type queryNode interface {
+	// Get the keys of the matching documents.
+	eval(s *searcher) (map[string]bool, error)
+}
+
+// A term, or a phrase of several terms in sequence.
+type phraseNode struct {
+	terms []string
+}
+
+// Documents matching both sides.
+type andNode struct {
+	left, right queryNode
+}
+
+// Documents matching either side.
+type orNode struct {
+	left, right queryNode
+}
+
+// Documents not matching the child.
+type notNode struct {
+	child queryNode
+}
+
+// Parse a search query. Terms must all match unless joined with OR, a term
+// or group preceded by NOT or "-" must not match, double quotes match a
+// phrase and parentheses group. Operators are upper case.
+func parseQuery(q string) (queryNode, error) {
+	p := &queryParser{tokens: lexQuery(q)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos])
+	}
+	return n, nil
+}
+
+// Split a search query into words, quoted phrases and parentheses. A quoted
+// phrase keeps its quotes so it is not taken for an operator.
+func lexQuery(q string) []string {
+	var tokens []string
+	for i := 0; i < len(q); {
+		switch c := q[i]; {
+		case c == '"':
+			end := strings.IndexByte(q[i+1:], '"')
+			if end < 0 {
+				end = len(q) - i - 1
+			}
+			tokens = append(tokens, `"`+q[i+1:i+1+end]+`"`)
+			i += end + 2
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		default:
+			end := strings.IndexFunc(q[i:], func(r rune) bool {
+				return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"'
+			})
+			if end < 0 {
+				end = len(q) - i
+			}
+			tokens = append(tokens, q[i:i+end])
+			i += end
+		}
+	}
+	return tokens
+}
+
+// Recursive descent parser for search queries.
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "OR" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "", ")", "OR":
+			return left, nil
+		case "AND":
+			p.pos++
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+}
+
+func (p *queryParser) parseNot() (queryNode, error) {
+	t := p.peek()
+	if t == "NOT" {
+		p.pos++
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{child}, nil
+	}
+	if t == "-" {
+		p.pos++
+		child, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{child}, nil
+	}
+	if len(t) > 1 && t[0] == '-' {
+		p.tokens[p.pos] = t[1:]
+		child, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{child}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	t := p.peek()
+	switch t {
+	case "":
+		return nil, fmt.Errorf("unexpected end of query")
+	case ")", "AND", "OR":
+		return nil, fmt.Errorf("unexpected %s", t)
+	case "(":
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return n, nil
+	}
+	p.pos++
+	var terms []string
+	for _, token := range tokenize(strings.Trim(t, `"`)) {
+		terms = append(terms, token.term)
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("no searchable terms in %s", t)
+	}
+	return &phraseNode{terms}, nil
+}
+
+// Get the phrases of a query that documents must contain, which are used
+// for ranking and highlighting. Phrases under NOT are left out.
+func positivePhrases(n queryNode) []*phraseNode {
+	switch n := n.(type) {
+	case *phraseNode:
+		return []*phraseNode{n}
+	case *andNode:
+		return append(positivePhrases(n.left), positivePhrases(n.right)...)
+	case *orNode:
+		return append(positivePhrases(n.left), positivePhrases(n.right)...)
+	}
+	return nil
+}
+
+// Evaluates a query against the search index in a read transaction.
+type searcher struct {
+	tx metaTx
+	// Positions of each term, by document key.
+	postings map[string]map[string][]int
+	// Occurrences of each phrase, by document key.
+	phrases map[*phraseNode]map[string]int
+}
+
+func newSearcher(tx metaTx) *searcher {
+	return &searcher{
+		tx:       tx,
+		postings: map[string]map[string][]int{},
+		phrases:  map[*phraseNode]map[string]int{},
+	}
+}
+
+// Get the positions of a term in every document containing it.
+func (s *searcher) termPostings(term string) (map[string][]int, error) {
+	if p, ok := s.postings[term]; ok {
+		return p, nil
+	}
+	p := map[string][]int{}
+	prefix := stringIndexPrefix(term)
+	c := s.tx.bucket(textPostingsBucket).cursor()
+	for k, v := c.seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.next() {
+		positions, err := decodePositions(v)
+		if err != nil {
+			return nil, err
+		}
+		p[string(k[len(prefix):])] = positions
+	}
+	s.postings[term] = p
+	return p, nil
+}
+
+// Count the occurrences of a phrase in every document containing it.
+func (s *searcher) phraseCounts(n *phraseNode) (map[string]int, error) {
+	if counts, ok := s.phrases[n]; ok {
+		return counts, nil
+	}
+	first, err := s.termPostings(n.terms[0])
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for key, positions := range first {
+		count := len(positions)
+		if len(n.terms) > 1 {
+			count, err = s.countPhrase(n.terms, key, positions)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if count > 0 {
+			counts[key] = count
+		}
+	}
+	s.phrases[n] = counts
+	return counts, nil
+}
+
+// Count the positions of the first term of a phrase in a document that are
+// followed by the rest of the phrase.
+func (s *searcher) countPhrase(terms []string, key string, starts []int) (int, error) {
+	next := make([]map[int]bool, len(terms))
+	for i, term := range terms[1:] {
+		p, err := s.termPostings(term)
+		if err != nil {
+			return 0, err
+		}
+		next[i+1] = map[int]bool{}
+		for _, pos := range p[key] {
+			next[i+1][pos] = true
+		}
+	}
+	count := 0
+	for _, start := range starts {
+		match := true
+		for i := 1; i < len(terms) && match; i++ {
+			match = next[i][start+i]
+		}
+		if match {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (n *phraseNode) eval(s *searcher) (map[string]bool, error) {
+	counts, err := s.phraseCounts(n)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for key := range counts {
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+func (n *andNode) eval(s *searcher) (map[string]bool, error) {
+	left, err := n.left.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for key := range left {
+		if right[key] {
+			keys[key] = true
+		}
+	}
+	return keys, nil
+}
+
+func (n *orNode) eval(s *searcher) (map[string]bool, error) {
+	left, err := n.left.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	for key := range right {
+		left[key] = true
+	}
+	return left, nil
+}
+
+func (n *notNode) eval(s *searcher) (map[string]bool, error) {
+	excluded, err := n.child.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	err = s.tx.bucket(textDocsBucket).forEach(func(k, v []byte) error {
+		if !excluded[string(k)] {
+			keys[string(k)] = true
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Score a matching document with BM25 over the positive phrases of a query.
+func (s *searcher) score(key string, phrases []*phraseNode, docs int64, avgLength float64) (float64, error) {
+	length, _ := decodeTextDoc(s.tx.bucket(textDocsBucket).get([]byte(key)))
+	score := 0.0
+	for _, n := range phrases {
+		counts, err := s.phraseCounts(n)
+		if err != nil {
+			return 0, err
+		}
+		tf := float64(counts[key])
+		if tf == 0 {
+			continue
+		}
+		df := float64(len(counts))
+		idf := math.Log(1 + (float64(docs)-df+0.5)/(df+0.5))
+		norm := 1 - bm25B
+		if avgLength > 0 {
+			norm += bm25B * float64(length) / avgLength
+		}
+		score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+	}
+	return score, nil
+}
+
+// Search the indexed text documents, returning a ranked page of results
+// and the total number of matching documents.
+func searchText(q queryNode, offset, limit int) (searchResults, int, error) {
+	var results searchResults
+	err := db.view(func(tx metaTx) error {
+		s := newSearcher(tx)
+		keys, err := q.eval(s)
+		if err != nil {
+			return err
+		}
+		docs := getTextStat(tx, textStatsDocs)
+		avgLength := 0.0
+		if docs > 0 {
+			avgLength = float64(getTextStat(tx, textStatsTerms)) / float64(docs)
+		}
+		phrases := positivePhrases(q)
+		for key := range keys {
+			score, err := s.score(key, phrases, docs, avgLength)
+			if err != nil {
+				return err
+			}
+			results = append(results, &SearchResult{DocumentEntry: DocumentEntry{Key: key}, Score: score})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Sort(results)
+	total := len(results)
+	if offset >= total {
+		return searchResults{}, total, nil
+	}
+	results = results[offset:]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, total, nil
+}
+
+// Make a snippet of text around the first match of a query phrase, with the
+// matching terms highlighted with <em> tags. The text is HTML escaped.
+func makeSnippet(text string, phrases []*phraseNode) string {
+	highlight := map[string]bool{}
+	for _, n := range phrases {
+		for _, term := range n.terms {
+			highlight[term] = true
+		}
+	}
+	tokens := tokenize(text)
+	first := -1
+	for i, t := range tokens {
+		if highlight[t.term] {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+	from := first - snippetContext/2
+	if from < 0 {
+		from = 0
+	}
+	to := from + snippetContext
+	if to > len(tokens) {
+		to = len(tokens)
+	}
+	var b bytes.Buffer
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := tokens[from].start
+	for _, t := range tokens[from:to] {
+		b.WriteString(html.EscapeString(text[pos:t.start]))
+		if highlight[t.term] {
+			b.WriteString("<em>" + html.EscapeString(text[t.start:t.end]) + "</em>")
+		} else {
+			b.WriteString(html.EscapeString(text[t.start:t.end]))
+		}
+		pos = t.end
+	}
+	if to < len(tokens) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// Parse an integer query parameter, with a default and an allowed range.
+func intParam(s string, def, min, max int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("must be between %d and %d", min, max)
+	}
+	return n, nil
+}
+
+// Search the text of the stored documents. The "q" query parameter holds
+// the query; "limit" and "offset" page through the results, which are
+// ranked by relevance and come with their metadata and a highlighted
+// snippet.
+func searchDocs(c echo.Context) error {
+	q, err := parseQuery(c.QueryParam("q"))
+	if err != nil {
+		return c.JSON(statusBadRequest, newErrorResp("", "invalid query", err))
+	}
+	limit, err := intParam(c.QueryParam("limit"), defaultSearchLimit, 1, maxSearchLimit)
+	if err != nil {
+		return c.JSON(statusBadRequest, newErrorResp("", "invalid limit", err))
+	}
+	offset, err := intParam(c.QueryParam("offset"), 0, 0, math.MaxInt32)
+	if err != nil {
+		return c.JSON(statusBadRequest, newErrorResp("", "invalid offset", err))
+	}
+	results, total, err := searchText(q, offset, limit)
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp("", "error searching documents", err))
+	}
+	phrases := positivePhrases(q)
+	found := searchResults{}
+	for _, result := range results {
+		metadata, err := getMetadata(result.Key)
+		if err == errKeyNotFound {
+			// Removed since it was found.
+			total--
+			continue
+		}
+		if err != nil {
+			return c.JSON(statusErr, newErrorResp(result.Key, "error reading metadata", err))
+		}
+		result.DocMetadata = *metadata
+		found = append(found, result)
+		if !indexesText(metadata) {
+			continue
+		}
+		text, err := readIndexText(func() (blobReader, error) { return openContents(result.Key, metadata) }, metadata)
+		if err == nil && text != nil {
+			result.Snippet = makeSnippet(string(text), phrases)
+		}
+	}
+	r := newSuccessResp("", "")
+	r.Results = found
+	r.Total = total
+	return c.JSON(statusOk, r)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSearchDocs = map[string]string{
+	"search-1": "The quick brown fox jumps over the lazy dog.",
+	"search-2": "A quick report on phishing: the phishing campaign used a fake login page.",
+	"search-3": "Brown bears and brown foxes live in the forest.",
+}
+
+// Search the documents, returning the keys of the results in rank order.
+func searchKeys(t *testing.T, q string) ([]string, *ResponseType) {
+	keys := []string{}
+	var resp ResponseType
+	gofight.New().GET("/search").
+		SetQuery(gofight.H{
+			"q": q,
+		}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				for _, result := range resp.Results {
+					keys = append(keys, result.Key)
+				}
+			}
+		})
+	return keys, &resp
+}
+
+func postSearchDocs(t *testing.T) {
+	for key, text := range testSearchDocs {
+		gofight.New().POST("/document/"+key).
+			SetHeader(gofight.H{
+				"Content-Type": "text/plain; charset=utf-8",
+			}).
+			SetBody(text).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+	}
+}
+
+func TestSearchDocs(t *testing.T) {
+	postSearchDocs(t)
+	defer cleanupDoc(t, "search-1")
+	defer cleanupDoc(t, "search-2")
+
+	keys, resp := searchKeys(t, "phishing")
+	assert.Equal(t, []string{"search-2"}, keys)
+	assert.Equal(t, 1, resp.Total)
+	if assert.Len(t, resp.Results, 1) {
+		assert.Contains(t, resp.Results[0].Snippet, "<em>phishing</em>")
+		assert.True(t, resp.Results[0].Score > 0, "Score should be positive")
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Results[0].ContentType)
+	}
+
+	// Brown appears twice in search-3, so it ranks first.
+	keys, _ = searchKeys(t, "brown")
+	assert.Equal(t, []string{"search-3", "search-1"}, keys)
+
+	keys, _ = searchKeys(t, `"quick brown"`)
+	assert.Equal(t, []string{"search-1"}, keys)
+
+	keys, _ = searchKeys(t, "quick AND brown")
+	assert.Equal(t, []string{"search-1"}, keys)
+
+	keys, _ = searchKeys(t, "quick -fox")
+	assert.Equal(t, []string{"search-2"}, keys)
+
+	keys, _ = searchKeys(t, "(phishing OR bears) NOT forest")
+	assert.Equal(t, []string{"search-2"}, keys)
+
+	keys, _ = searchKeys(t, "Phishing OR BEARS")
+	assert.Len(t, keys, 2)
+
+	gofight.New().GET("/search").
+		SetQuery(gofight.H{
+			"q": "(quick",
+		}).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		})
+
+	// Replaced and deleted documents leave the index.
+	gofight.New().PUT("/document/search-2").
+		SetHeader(gofight.H{
+			"Content-Type": "text/plain",
+		}).
+		SetBody("Nothing to see here.").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	keys, _ = searchKeys(t, "phishing")
+	assert.Empty(t, keys)
+	cleanupDoc(t, "search-3")
+	keys, _ = searchKeys(t, "bears")
+	assert.Empty(t, keys)
+}
+
+func TestSearchRemovedDoc(t *testing.T) {
+	postSearchDocs(t)
+	for key := range testSearchDocs {
+		defer cleanupDoc(t, key)
+	}
+	// Take out the metadata of a document as if it was removed between
+	// finding it and reading its metadata, and put it back afterwards.
+	var v []byte
+	err := db.update(func(tx metaTx) error {
+		b := tx.bucket(dbBucket)
+		v = append([]byte{}, b.get([]byte("search-1"))...)
+		return b.delete([]byte("search-1"))
+	})
+	assert.NoError(t, err)
+	keys, resp := searchKeys(t, "brown")
+	assert.Equal(t, []string{"search-3"}, keys)
+	assert.Equal(t, 1, resp.Total)
+	err = db.update(func(tx metaTx) error {
+		return tx.bucket(dbBucket).put([]byte("search-1"), v)
+	})
+	assert.NoError(t, err)
+}
+
+func TestRebuildTextIndex(t *testing.T) {
+	postSearchDocs(t)
+	for key := range testSearchDocs {
+		defer cleanupDoc(t, key)
+	}
+	err := db.update(func(tx metaTx) error {
+		return unindexText(tx, "search-2")
+	})
+	assert.NoError(t, err)
+	keys, _ := searchKeys(t, "phishing")
+	assert.Empty(t, keys)
+
+	n, err := rebuildTextIndex()
+	if assert.NoError(t, err) {
+		assert.True(t, n >= len(testSearchDocs), "All test documents should be indexed")
+	}
+	keys, _ = searchKeys(t, "phishing")
+	assert.Equal(t, []string{"search-2"}, keys)
+}
+
+func TestParseQuery(t *testing.T) {
+	for _, q := range []string{"", "AND", "a OR", "(a", "a )", "NOT", "..."} {
+		_, err := parseQuery(q)
+		assert.Error(t, err, "Query %q should not parse", q)
+	}
+	n, err := parseQuery(`a "b c" OR -d`)
+	if assert.NoError(t, err) {
+		assert.Len(t, positivePhrases(n), 2)
+	}
+}
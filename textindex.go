@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Maximum number of bytes of a document that are indexed for search.
+const maxTextIndexSize = 16 << 20
+
+// Maximum length in bytes of an indexed term. Longer terms are truncated.
+const maxTermLen = 64
+
+// Database buckets holding the full-text search index.
+var (
+	// Postings keyed by term and document key, holding the positions of
+	// the term in the document.
+	textPostingsBucket = []byte("TextPostings")
+	// Indexed documents keyed by document key, holding the document length
+	// in terms and the terms it contains.
+	textDocsBucket = []byte("TextDocs")
+	// Totals over the indexed documents, used for ranking.
+	textStatsBucket = []byte("TextStats")
+)
+
+// Keys in the text stats bucket.
+var (
+	textStatsDocs  = []byte("docs")
+	textStatsTerms = []byte("terms")
+)
+
+// A term in a text, with its byte offsets.
+type textToken struct {
+	term  string
+	start int
+	end   int
+}
+
+// Split a text into lowercase terms of letters and digits.
+func tokenize(text string) []textToken {
+	var tokens []textToken
+	start := -1
+	for i, r := range text {
+		word := r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+		if word && start < 0 {
+			start = i
+		} else if !word && start >= 0 {
+			tokens = append(tokens, newTextToken(text, start, i))
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, newTextToken(text, start, len(text)))
+	}
+	return tokens
+}
+
+func newTextToken(text string, start, end int) textToken {
+	term := strings.ToLower(text[start:end])
+	if len(term) > maxTermLen {
+		term = term[:maxTermLen]
+		for !utf8.ValidString(term) {
+			term = term[:len(term)-1]
+		}
+	}
+	return textToken{term: term, start: start, end: end}
+}
+
+// Check if a content type holds text that should be indexed for search.
+func isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-javascript":
+		return true
+	}
+	return false
+}
+
+// Read the text to index from the contents of a document opened with a
+// function, or nil if the document is not text. At most maxTextIndexSize
+// bytes are read.
+func readIndexText(open func() (blobReader, error), metadata *DocMetadata) ([]byte, error) {
+	if !isTextContentType(metadata.ContentType) {
+		return nil, nil
+	}
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := &bytes.Buffer{}
+	_, err = io.Copy(buf, io.LimitReader(f, maxTextIndexSize))
+	return buf.Bytes(), err
+}
+
+// Get the postings key of a term in a document.
+func postingKey(term, key string) []byte {
+	return append(stringIndexPrefix(term), key...)
+}
+
+// Encode term positions as deltas of unsigned varints.
+func encodePositions(positions []int) []byte {
+	buf := make([]byte, len(positions)*binary.MaxVarintLen32)
+	n, prev := 0, 0
+	for _, p := range positions {
+		n += binary.PutUvarint(buf[n:], uint64(p-prev))
+		prev = p
+	}
+	return buf[:n]
+}
+
+// Decode term positions encoded with encodePositions.
+func decodePositions(v []byte) ([]int, error) {
+	var positions []int
+	prev := 0
+	for len(v) > 0 {
+		d, n := binary.Uvarint(v)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid term positions")
+		}
+		prev += int(d)
+		positions = append(positions, prev)
+		v = v[n:]
+	}
+	return positions, nil
+}
+
+// Encode an indexed document entry: its length in terms, then its terms.
+func encodeTextDoc(length int, terms []string) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(length))
+	return append(buf[:n], strings.Join(terms, "\x00")...)
+}
+
+// Decode an indexed document entry into its length and terms.
+func decodeTextDoc(v []byte) (int, []string) {
+	length, n := binary.Uvarint(v)
+	if n <= 0 {
+		return 0, nil
+	}
+	if len(v) == n {
+		return int(length), nil
+	}
+	return int(length), strings.Split(string(v[n:]), "\x00")
+}
+
+// Read a counter in the text stats bucket.
+func getTextStat(tx metaTx, name []byte) int64 {
+	v := tx.bucket(textStatsBucket).get(name)
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+// Add to a counter in the text stats bucket.
+func addTextStat(tx metaTx, name []byte, delta int64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(getTextStat(tx, name)+delta))
+	return tx.bucket(textStatsBucket).put(name, v)
+}
+
+// Index the text of a document for search within a transaction, replacing
+// any earlier index entries for the key. A nil text only removes them.
+func indexText(tx metaTx, key string, text []byte) error {
+	if err := unindexText(tx, key); err != nil {
+		return err
+	}
+	if text == nil {
+		return nil
+	}
+	tokens := tokenize(string(text))
+	positions := map[string][]int{}
+	for i, t := range tokens {
+		positions[t.term] = append(positions[t.term], i)
+	}
+	postings := tx.bucket(textPostingsBucket)
+	terms := make([]string, 0, len(positions))
+	for term, p := range positions {
+		if err := postings.put(postingKey(term, key), encodePositions(p)); err != nil {
+			return err
+		}
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	if err := tx.bucket(textDocsBucket).put([]byte(key), encodeTextDoc(len(tokens), terms)); err != nil {
+		return err
+	}
+	if err := addTextStat(tx, textStatsDocs, 1); err != nil {
+		return err
+	}
+	return addTextStat(tx, textStatsTerms, int64(len(tokens)))
+}
+
+// Remove the search index entries of a document within a transaction.
+func unindexText(tx metaTx, key string) error {
+	docs := tx.bucket(textDocsBucket)
+	v := docs.get([]byte(key))
+	if v == nil {
+		return nil
+	}
+	length, terms := decodeTextDoc(v)
+	postings := tx.bucket(textPostingsBucket)
+	for _, term := range terms {
+		if err := postings.delete(postingKey(term, key)); err != nil {
+			return err
+		}
+	}
+	if err := docs.delete([]byte(key)); err != nil {
+		return err
+	}
+	if err := addTextStat(tx, textStatsDocs, -1); err != nil {
+		return err
+	}
+	return addTextStat(tx, textStatsTerms, -int64(length))
+}
+
+// Rebuild the search index from the stored documents, for documents stored
+// before the index existed or after changing what is indexed. Each document
+// is indexed in its own transaction. Returns the number of documents
+// indexed.
+func rebuildTextIndex() (int, error) {
+	err := db.update(func(tx metaTx) error {
+		for _, bucket := range [][]byte{textPostingsBucket, textDocsBucket, textStatsBucket} {
+			if err := tx.deleteBucket(bucket); err != nil && err != errBucketNotFound {
+				return err
+			}
+			if _, err := tx.createBucket(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var keys []string
+	err = db.view(func(tx metaTx) error {
+		return tx.bucket(dbBucket).forEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, key := range keys {
+		metadata, err := getMetadata(key)
+		if err != nil || !indexesText(metadata) {
+			// Removed since listing, unreadable, or encrypted.
+			continue
+		}
+		text, err := readIndexText(func() (blobReader, error) { return openContents(key, metadata) }, metadata)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return count, fmt.Errorf("error reading document %s: %s", key, err)
+		}
+		if text == nil {
+			continue
+		}
+		err = db.update(func(tx metaTx) error {
+			return indexText(tx, key, text)
+		})
+		if err != nil {
+			return count, fmt.Errorf("error indexing document %s: %s", key, err)
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Directory in the data directory holding the contents of earlier versions
+// of documents, in a sub-directory per document.
+const versionsDir = ".versions"
+
+// Database bucket holding the metadata of earlier versions of documents, in
+// a nested bucket per document keyed by version number.
+var versionsBucket = []byte("DocVersions")
+
+// Get the version number of a document, which is 1 for documents stored
+// before versions were recorded.
+func docVersion(metadata *DocMetadata) int {
+	if metadata.Version <= 0 {
+		return 1
+	}
+	return metadata.Version
+}
+
+// Path to the contents of an earlier version of a document stored under its
+// key, in the sharded layout or, if not yet migrated, in versionsDir.
+func versionPath(key string, version int) string {
+	name := keyFileName(key)
+	return locate(path.Join(shardedVersionDir(name), strconv.Itoa(version)), path.Join(dataDir, versionsDir, name, strconv.Itoa(version)))
+}
+
+// Encode a version number as a database key that sorts in numeric order.
+func versionKey(version int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(version))
+	return k
+}
+
+// Move the current metadata of a document into its history within a
+// transaction. The history keeps a reference to the contents, and the
+// contents of a document stored without a digest are moved along with it.
+// Returns the version number of the archived document, or 0 if there was no
+// document to archive.
+func archiveDocument(tx metaTx, key string) (int, error) {
+	metadata, err := decodeMetadata(tx.bucket(dbBucket).get([]byte(key)))
+	if err == errKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version := docVersion(metadata)
+	metadata.Version = version
+	if metadata.SHA256 == "" {
+		dir := shardedVersionDir(keyFileName(key))
+		if err = os.MkdirAll(dir, 0777); err != nil {
+			return 0, err
+		}
+		err = retryMoved(func() string { return legacyPath(key) }, func(p string) error {
+			return os.Rename(p, path.Join(dir, strconv.Itoa(version)))
+		})
+		if os.IsNotExist(err) {
+			// Only a stale metadata record is left, which is overwritten.
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	buf, err := encodeMetadata(metadata)
+	if err != nil {
+		return 0, err
+	}
+	b, err := tx.bucket(versionsBucket).createBucketIfNotExists([]byte(key))
+	if err != nil {
+		return 0, err
+	}
+	if err = b.put(versionKey(version), buf); err != nil {
+		return 0, err
+	}
+	return version, addBlobRef(tx, blobName(metadata), 1)
+}
+
+// Get the metadata of an earlier version of a document.
+func getVersionMetadata(key string, version int) (*DocMetadata, error) {
+	var metadata *DocMetadata
+	err := db.view(func(tx metaTx) error {
+		b := tx.bucket(versionsBucket).bucket([]byte(key))
+		if b == nil {
+			return errKeyNotFound
+		}
+		var err error
+		metadata, err = decodeMetadata(b.get(versionKey(version)))
+		return err
+	})
+	return metadata, err
+}
+
+// List the metadata of all earlier versions of a document, oldest first.
+func listVersions(key string) ([]*DocMetadata, error) {
+	var versions []*DocMetadata
+	err := db.view(func(tx metaTx) error {
+		b := tx.bucket(versionsBucket).bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		return b.forEach(func(k, v []byte) error {
+			metadata, err := decodeMetadata(v)
+			if err != nil {
+				return err
+			}
+			versions = append(versions, metadata)
+			return nil
+		})
+	})
+	return versions, err
+}
+
+// Remove the history of a document, releasing its references to contents.
+func deleteVersions(key string) error {
+	err := updateBlobs(func(tx metaTx) error {
+		b := tx.bucket(versionsBucket).bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		err := b.forEach(func(k, v []byte) error {
+			metadata, err := decodeMetadata(v)
+			if err != nil {
+				return nil
+			}
+			return addBlobRef(tx, blobName(metadata), -1)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.bucket(versionsBucket).deleteBucket([]byte(key))
+	})
+	if err != nil {
+		return err
+	}
+	// The flat layout first, so files moved by a concurrent migration are
+	// still removed.
+	if err = os.RemoveAll(path.Join(dataDir, versionsDir, keyFileName(key))); err != nil {
+		return err
+	}
+	return os.RemoveAll(shardedVersionDir(keyFileName(key)))
+}
+
+// Remove one earlier version of a document, releasing its reference to its
+// contents. A version record that cannot be decoded is removed too.
+func deleteVersion(key string, version int) error {
+	return updateBlobs(func(tx metaTx) error {
+		b := tx.bucket(versionsBucket).bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		if metadata, err := decodeMetadata(b.get(versionKey(version))); err == nil {
+			if err = addBlobRef(tx, blobName(metadata), -1); err != nil {
+				return err
+			}
+		}
+		return b.delete(versionKey(version))
+	})
+}
+
+// Get the requested version of a document, which may be the current one.
+// Returns a function opening its contents, and its metadata.
+func findVersion(key string, version int) (func() (blobReader, error), *DocMetadata, error) {
+	metadata, err := getMetadata(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version == docVersion(metadata) {
+		metadata.Version = version
+		return func() (blobReader, error) { return openContents(key, metadata) }, metadata, nil
+	}
+	metadata, err = getVersionMetadata(key, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func() (blobReader, error) { return openVersionContents(key, version, metadata) }, metadata, nil
+}
+
+// Open the contents of an earlier version of a document.
+func openVersionContents(key string, version int, metadata *DocMetadata) (blobReader, error) {
+	return decompressContents(metadata, func() (blobReader, error) {
+		if metadata.SHA256 != "" {
+			return decryptContents(metadata, func() (blobReader, error) { return openBlob(metadata) })
+		}
+		return openMoved(func() string { return versionPath(key, version) })
+	})
+}
+
+// Parse the version number route parameter.
+func versionParam(c echo.Context) (int, error) {
+	version, err := strconv.Atoi(c.Param("n"))
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("invalid version %s", c.Param("n"))
+	}
+	return version, nil
+}
+
+// List all versions of a document, oldest first. The last one is the
+// current version.
+func getDocVersions(c echo.Context) error {
+	key := c.Param("id")
+	metadata, err := getMetadata(key)
+	if err == errKeyNotFound {
+		return c.JSON(statusNotFound, newErrorResp(key, "key not found", err))
+	}
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp(key, "error reading metadata", err))
+	}
+	versions, err := listVersions(key)
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp(key, "error reading versions", err))
+	}
+	metadata.Version = docVersion(metadata)
+	r := newMetadataResp(key, "", metadata)
+	r.Versions = append(versions, metadata)
+	return c.JSON(statusOk, r)
+}
+
+// Get a version of a document and its metadata.
+func getDocVersion(c echo.Context) error {
+	key := c.Param("id")
+	version, err := versionParam(c)
+	if err != nil {
+		return c.JSON(statusBadRequest, newErrorResp(key, "invalid version", err))
+	}
+	open, metadata, err := findVersion(key, version)
+	if err == errKeyNotFound {
+		return c.JSON(statusNotFound, newErrorResp(key, "version not found", err))
+	}
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp(key, "error reading metadata", err))
+	}
+	f, err := open()
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp(key, "error reading file", err))
+	}
+	defer f.Close()
+	d, err := ioutil.ReadAll(f)
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp(key, "error reading file", err))
+	}
+	r := newMetadataResp(key, "", metadata)
+	r.Document = string(d)
+	return c.JSON(statusOk, r)
+}
+
+// Restore an earlier version of a document. The current version is kept in
+// the history, and the restored contents and metadata become a new version.
+// With If-Match, the current version is only replaced if its ETag matches.
+func restoreDocVersion(c echo.Context) error {
+	key := c.Param("id")
+	version, err := versionParam(c)
+	if err != nil {
+		return c.JSON(statusBadRequest, newErrorResp(key, "invalid version", err))
+	}
+	open, metadata, err := findVersion(key, version)
+	if err == errKeyNotFound {
+		return c.JSON(statusNotFound, newErrorResp(key, "version not found", err))
+	}
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp(key, "error reading metadata", err))
+	}
+	src, err := open()
+	if err != nil {
+		return c.JSON(statusErr, newErrorResp(key, "unable to open data", err))
+	}
+	defer src.Close()
+	metadata.Timestamp = time.Now().Unix()
+	opts := saveOptions{overwrite: true, ifMatch: c.Request().Header.Get("If-Match")}
+	doc, code, res := writeDocument(key, src, metadata, opts)
+	if doc == nil {
+		return c.JSON(code, res)
+	}
+	if err = commitDocuments(doc); err != nil {
+		return c.JSON(statusErr, newErrorResp(key, "error restoring version", err))
+	}
+	if code, res = doc.result(res); code != statusOk {
+		return c.JSON(code, res)
+	}
+	return docJSON(c, statusOk, newMetadataResp(key, fmt.Sprintf("restored version %d", version), metadata))
+}
+
+// A document with its contents written to a temporary file, waiting to be
+// committed.
+type pendingDocument struct {
+	key      string
+	metadata *DocMetadata
+	text     []byte
+	tmpPath  string
+	// Whether to replace an existing document.
+	overwrite bool
+	// Whether to keep an existing document with the same contents instead.
+	dedupe bool
+	// If-Match header the document being replaced must match, if not empty.
+	ifMatch string
+	// Key of the existing document kept instead, once committed.
+	existing string
+	// Why the document was not committed, if it conflicts with the current
+	// state of the database.
+	err error
+}
+
+// Get the HTTP status code and response for a committed document, given the
+// response for writing it.
+func (doc *pendingDocument) result(res *ResponseType) (int, *ResponseType) {
+	switch {
+	case doc.err == errDocumentExists:
+		return statusConflict, newErrorResp(doc.key, "file exists", fmt.Errorf("file already exists for key %s", doc.key))
+	case doc.err != nil:
+		return statusPreconditionFailed, newErrorResp(doc.key, "precondition failed", doc.err)
+	case doc.existing != "":
+		res = newSuccessResp(doc.existing, "identical document exists")
+		res.SHA256 = doc.metadata.SHA256
+		return statusOk, res
+	}
+	res.ETag = docETag(doc.metadata)
+	setDigestFields(res, doc.metadata)
+	return statusOk, res
+}
+
+// Check a document against the current state of the database within a
+// transaction, before committing it.
+func (doc *pendingDocument) check(tx metaTx) error {
+	v := tx.bucket(dbBucket).get([]byte(doc.key))
+	if !doc.overwrite && v != nil {
+		return errDocumentExists
+	}
+	if doc.ifMatch == "" {
+		return nil
+	}
+	current, err := decodeMetadata(v)
+	if err != nil {
+		current = nil
+	}
+	return ifMatch(doc.ifMatch, current)
+}
+
+// Commit documents written with writeDocument in one transaction: move
+// their contents into the blob store, archive their current versions, and
+// save their metadata and search index entries. Each document is checked
+// within the transaction, so of concurrent requests creating the same key
+// only one succeeds. A document that conflicts with the database, or that
+// is deduplicated, is left out and gets its outcome in its fields. The
+// contents are on disk before the metadata referring to them is committed,
+// so after a crash a document is either complete or missing. Blobs are
+// uploaded before the transaction. The temporary files are removed
+// afterwards.
+func commitDocuments(docs ...*pendingDocument) error {
+	var uploaded []func()
+	defer func() {
+		for _, done := range uploaded {
+			done()
+		}
+		for _, doc := range docs {
+			os.Remove(doc.tmpPath)
+		}
+	}()
+	for _, doc := range docs {
+		done, err := uploadContents(doc)
+		if err != nil {
+			return err
+		}
+		if done != nil {
+			uploaded = append(uploaded, done)
+		}
+	}
+	return updateBlobs(func(tx metaTx) error {
+		for _, doc := range docs {
+			doc.existing = ""
+			if doc.err = doc.check(tx); doc.err != nil {
+				continue
+			}
+			if doc.dedupe {
+				if doc.existing = findDigest(tx, doc.metadata.SHA256); doc.existing != "" {
+					continue
+				}
+			}
+			if err := putContents(tx, doc); err != nil {
+				return err
+			}
+			previous, err := archiveDocument(tx, doc.key)
+			if err != nil {
+				return fmt.Errorf("error archiving previous version: %s", err)
+			}
+			doc.metadata.Version = previous + 1
+			if err := putMetadata(tx, doc.key, doc.metadata); err != nil {
+				return err
+			}
+			if err := indexText(tx, doc.key, doc.text); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/appleboy/gofight"
+	"github.com/stretchr/testify/assert"
+)
+
+const testVersionsKey = "versions-123"
+
+func TestDocVersions(t *testing.T) {
+	for _, body := range []string{`{"v": 1}`, `{"v": 2}`} {
+		gofight.New().PUT("/document/"+testVersionsKey).
+			SetBody(body).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+	}
+
+	r := gofight.New()
+	r.GET("/document/"+testVersionsKey+"/versions").
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) && assert.Len(t, resp.Versions, 2) {
+				assert.Equal(t, 2, resp.Version, "Current version should be 2")
+				assert.Equal(t, 1, resp.Versions[0].Version)
+				assert.Equal(t, 2, resp.Versions[1].Version)
+			}
+		})
+
+	r.GET("/document/"+testVersionsKey+"/versions/1").
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.JSONEq(t, `{"v": 1}`, resp.Document)
+				assert.Equal(t, 1, resp.Version)
+			}
+		})
+
+	r.GET("/document/"+testVersionsKey+"/versions/5").
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotFound, r.Code)
+		})
+
+	r.POST("/document/"+testVersionsKey+"/versions/1/restore").
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+
+	r.GET("/document/"+testVersionsKey).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var resp ResponseType
+			err := json.Unmarshal([]byte(r.Body.String()), &resp)
+			if assert.NoError(t, err) {
+				assert.JSONEq(t, `{"v": 1}`, resp.Document)
+				assert.Equal(t, 3, resp.Version, "Restored version should be 3")
+			}
+		})
+
+	r.DELETE("/document/"+testVersionsKey).
+		SetDebug(true).
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+
+	versions, err := listVersions(testVersionsKey)
+	assert.NoError(t, err)
+	assert.Empty(t, versions, "Versions should be removed with the document")
+}